@@ -26,6 +26,7 @@ import (
 	"github.com/wcharczuk/go-chart"
 	"github.com/wcharczuk/go-chart/drawing"
 	"log"
+	"math"
 	"net/http"
 	"sort"
 	"strconv"
@@ -34,11 +35,19 @@ import (
 )
 
 type DataPoint struct {
-	Date        time.Time
-	NewCount    int
-	Count       int
-	NewDeceased int
-	Deceased    int
+	Date           time.Time
+	NewCount       int
+	Count          int
+	NewDeceased    int
+	Deceased       int
+	NewRecovered   int
+	Recovered      int
+	NewActive      int
+	Active         int
+	NewMetric      int
+	Metric         int
+	Filled         bool
+	MetricReported bool
 }
 
 type CasesChartSeries struct {
@@ -60,12 +69,16 @@ type DataSeries struct {
 	First        time.Time
 	Last         time.Time
 	Current      *DataPoint
-	Cases        int
-	Deaths       int
+	ActiveCases  int
+	MetricTotal  int
 	DataPoints   []*DataPoint
+	samples      map[int][]*Sample
 
 	ConfirmedData *CasesChartSeries
 	DeceasedData  *CasesChartSeries
+	MetricData    *CasesChartSeries
+	RecoveredData *CasesChartSeries
+	ActiveData    *CasesChartSeries
 }
 
 const (
@@ -77,22 +90,38 @@ const (
 	ChartTypeMortality  = "MORTALITY"
 )
 
+// Gap policies for the days a jurisdiction has no sample.
 const (
-	ChartDataCases  = 0
-	ChartDataDeaths = 1
+	GapCarryForward = "carry"
+	GapInterpolate  = "interpolate"
+	GapLeaveNull    = "null"
+)
+
+const (
+	ChartDataCases     = 0
+	ChartDataDeaths    = 1
+	ChartDataMetric    = 2
+	ChartDataRecovered = 3
+	ChartDataActive    = 4
 )
 
 type CasesChartData struct {
-	Manager         *grumble.EntityManager
-	Query           *grumble.Query
-	Country         *Jurisdiction
-	Jurisdictions   []grumble.Persistable
-	Regions         []grumble.Persistable
-	Exclude         []grumble.Persistable
-	Aggregate       bool
-	ChartTypeCases  string
-	ChartTypeDeaths string
-	Regression      bool
+	Manager            *grumble.EntityManager
+	Query              *grumble.Query
+	Country            *Jurisdiction
+	Jurisdictions      []grumble.Persistable
+	Regions            []grumble.Persistable
+	Exclude            []grumble.Persistable
+	Aggregate          bool
+	Units              bool
+	ChartTypeCases     string
+	ChartTypeDeaths    string
+	ChartTypeMetric    string
+	Metric             *Metric
+	ChartTypeRecovered string
+	ChartTypeActive    string
+	GapPolicy          string
+	Regression         bool
 
 	Results     [][]grumble.Persistable
 	Series      map[string]*DataSeries
@@ -146,10 +175,16 @@ func MakeDataSeries(data *CasesChartData, jurisdiction *Jurisdiction, color draw
 	series.First = first.Date
 	series.Current = nil
 	series.DataPoints = make([]*DataPoint, 0)
+	series.samples = make(map[int][]*Sample)
 	data.Series[name] = series
 
 	series.ConfirmedData = MakeCasesChartSeries(series, ChartDataCases, series.ChartData.ChartTypeCases, series.ChartData.Regression)
 	series.DeceasedData = MakeCasesChartSeries(series, ChartDataDeaths, series.ChartData.ChartTypeDeaths, series.ChartData.Regression)
+	if data.Metric != nil {
+		series.MetricData = MakeCasesChartSeries(series, ChartDataMetric, series.ChartData.ChartTypeMetric, false)
+	}
+	series.RecoveredData = MakeCasesChartSeries(series, ChartDataRecovered, series.ChartData.ChartTypeRecovered, false)
+	series.ActiveData = MakeCasesChartSeries(series, ChartDataActive, series.ChartData.ChartTypeActive, false)
 
 	return
 }
@@ -157,18 +192,37 @@ func MakeDataSeries(data *CasesChartData, jurisdiction *Jurisdiction, color draw
 func (series *DataSeries) AppendSample(sample *Sample) {
 	if series.Current == nil || series.Current.Date.Before(sample.Date) {
 		if series.Current != nil {
-			series.Current.NewCount = series.Current.Count - series.Cases
-			series.Current.NewDeceased = series.Current.Deceased - series.Deaths
-			series.Cases = series.Current.Count
-			series.Deaths = series.Current.Deceased
+			series.closeDataPoint()
 		}
 		series.Last = sample.Date
 		series.Current = new(DataPoint)
 		series.Current.Date = sample.Date
 		series.DataPoints = append(series.DataPoints, series.Current)
 	}
+	series.Current.Filled = series.Current.Filled || sample.filled
 	series.Current.Count += sample.Confirmed
+	series.Current.NewCount += sample.NewConfirmed
 	series.Current.Deceased += sample.Deceased
+	series.Current.NewDeceased += sample.NewDeceased
+	series.Current.Recovered += sample.Recovered
+	series.Current.NewRecovered += sample.NewRecovered
+	series.Current.Active += sample.Active()
+	if series.ChartData.Metric != nil {
+		if value, ok := series.ChartData.Metric.Value(sample); ok {
+			series.Current.Metric += value
+			series.Current.MetricReported = true
+		}
+	}
+}
+
+func (series *DataSeries) closeDataPoint() {
+	series.Current.NewActive = series.Current.Active - series.ActiveCases
+	if !series.Current.MetricReported {
+		series.Current.Metric = series.MetricTotal
+	}
+	series.Current.NewMetric = series.Current.Metric - series.MetricTotal
+	series.ActiveCases = series.Current.Active
+	series.MetricTotal = series.Current.Metric
 }
 
 func (data *CasesChartData) GetDataSeries(jurisdiction *Jurisdiction, first *Sample) (series *DataSeries) {
@@ -185,6 +239,26 @@ func (data *CasesChartData) GetDataSeries(jurisdiction *Jurisdiction, first *Sam
 	return
 }
 
+// chartJurisdiction takes a name that doesn't match as a typo if there is a
+// single close match.
+func chartJurisdiction(parent *Jurisdiction, name string) (j *Jurisdiction) {
+	if name = strings.TrimSpace(name); name == "" {
+		return nil
+	}
+	if parent == nil {
+		j = GetJurisdiction(name)
+	} else {
+		j = parent.GetRegion(name)
+	}
+	if j != nil {
+		return
+	}
+	if suggestions := Registry.Suggest(parent, name, 2); len(suggestions) == 1 {
+		return suggestions[0]
+	}
+	return nil
+}
+
 func MakeCasesChartData(req *http.Request) (ret *CasesChartData, err error) {
 	ret = new(CasesChartData)
 	if ret.Manager, err = grumble.MakeEntityManager(); err != nil {
@@ -196,7 +270,7 @@ func MakeCasesChartData(req *http.Request) (ret *CasesChartData, err error) {
 			if len(ret.Jurisdictions) == 6 {
 				break
 			}
-			j := GetJurisdiction(country)
+			j := chartJurisdiction(nil, country)
 			if j != nil {
 				ret.Jurisdictions = append(ret.Jurisdictions, j)
 			}
@@ -205,6 +279,7 @@ func MakeCasesChartData(req *http.Request) (ret *CasesChartData, err error) {
 
 	exclude := req.FormValue("exclude")
 	ret.Aggregate = req.FormValue("breakout") != "true"
+	ret.Units = req.FormValue("units") != "false"
 	switch {
 	case len(ret.Jurisdictions) == 1 && !ret.Aggregate:
 		ret.Country = ret.Jurisdictions[0].(*Jurisdiction)
@@ -215,13 +290,13 @@ func MakeCasesChartData(req *http.Request) (ret *CasesChartData, err error) {
 				if ix > 5 {
 					break
 				}
-				r := ret.Country.GetRegion(region)
+				r := chartJurisdiction(ret.Country, region)
 				if r != nil {
 					ret.Jurisdictions = append(ret.Jurisdictions, r)
 				}
 			}
 		default:
-			if len(ret.Country.regions) > 1 {
+			if len(ret.Country.Regions()) > 0 {
 				if ret.Jurisdictions, err = ret.Country.TopRegions(6, true, strings.Split(exclude, ",")); err != nil {
 					return
 				}
@@ -230,11 +305,11 @@ func MakeCasesChartData(req *http.Request) (ret *CasesChartData, err error) {
 	case len(ret.Jurisdictions) == 1 && ret.Aggregate:
 		ret.Country = ret.Jurisdictions[0].(*Jurisdiction)
 		ret.Regions = make([]grumble.Persistable, 0)
-		if len(ret.Country.regions) > 1 {
+		if len(ret.Country.Regions()) > 0 {
 			switch {
 			case req.FormValue("include") != "":
 				for _, region := range strings.Split(req.FormValue("include"), ",") {
-					r := ret.Country.GetRegion(region)
+					r := chartJurisdiction(ret.Country, region)
 					if r != nil {
 						ret.Regions = append(ret.Regions, r)
 					}
@@ -242,12 +317,12 @@ func MakeCasesChartData(req *http.Request) (ret *CasesChartData, err error) {
 			case req.FormValue("exclude") != "":
 				excl := make(map[int]bool, 0)
 				for _, region := range strings.Split(req.FormValue("exclude"), ",") {
-					r := ret.Country.GetRegion(region)
+					r := chartJurisdiction(ret.Country, region)
 					if r != nil {
 						excl[r.Ident] = true
 					}
 				}
-				for _, r := range ret.Country.regions {
+				for _, r := range ret.Country.Regions() {
 					if ok, _ := excl[r.Ident]; !ok {
 						ret.Regions = append(ret.Regions, r)
 					}
@@ -261,11 +336,14 @@ func MakeCasesChartData(req *http.Request) (ret *CasesChartData, err error) {
 	default:
 		ret.Exclude = make([]grumble.Persistable, 0)
 		for _, country := range strings.Split(exclude, ",") {
-			if j := GetJurisdiction(country); j != nil {
+			if j := chartJurisdiction(nil, country); j != nil {
 				ret.Exclude = append(ret.Exclude, j)
 			}
 		}
 	}
+	if !ret.Units && ret.Country == nil {
+		ret.Exclude = append(ret.Exclude, NonGeographicUnits()...)
+	}
 	ret.Query = ret.Manager.MakeQuery(Sample{})
 
 	ret.ChartTypeCases = ChartTypeAbsolute
@@ -276,6 +354,20 @@ func MakeCasesChartData(req *http.Request) (ret *CasesChartData, err error) {
 	if req.FormValue("deaths") != "" {
 		ret.ChartTypeDeaths = req.FormValue("deaths")
 	}
+	ret.GapPolicy = GapCarryForward
+	switch p := req.FormValue("gaps"); p {
+	case GapInterpolate, GapLeaveNull:
+		ret.GapPolicy = p
+	}
+	ret.ChartTypeRecovered = seriesChartType(req.FormValue("recovered"))
+	ret.ChartTypeActive = seriesChartType(req.FormValue("active"))
+	if ret.Metric = GetMetric(req.FormValue("metric")); ret.Metric != nil {
+		ret.ChartTypeMetric = ChartTypeAbsolute
+		switch t := req.FormValue("metrictype"); t {
+		case ChartTypeAbsolute, ChartTypeRelative, ChartTypeDaily, ChartTypeRollingAvg:
+			ret.ChartTypeMetric = t
+		}
+	}
 	ret.Regression = false
 	if (ret.ChartTypeCases == ChartTypeDaily) || (ret.ChartTypeCases == ChartTypeRollingAvg) {
 		ret.ChartTypeDeaths = ret.ChartTypeCases
@@ -286,13 +378,25 @@ func MakeCasesChartData(req *http.Request) (ret *CasesChartData, err error) {
 	return
 }
 
+func seriesChartType(t string) string {
+	switch t {
+	case ChartTypeAbsolute, ChartTypeRelative, ChartTypeDaily, ChartTypeRollingAvg:
+		return t
+	default:
+		return ChartTypeSuppress
+	}
+}
+
 func (data *CasesChartData) TopCountries(number int, cases bool, exclude []string) (countries []grumble.Persistable, err error) {
 	excludes := make([]grumble.Persistable, 0)
 	for _, excl := range exclude {
-		if e := GetJurisdiction(excl); e != nil {
+		if e := chartJurisdiction(nil, excl); e != nil {
 			excludes = append(excludes, e)
 		}
 	}
+	if !data.Units {
+		excludes = append(excludes, NonGeographicUnits()...)
+	}
 	q := data.Manager.MakeQuery(Sample{})
 	q.AddCondition(&grumble.References{
 		Column:     "Jurisdiction",
@@ -364,12 +468,18 @@ func (data *CasesChartData) BuildSeries() (err error) {
 			jurisdiction = row[1].(*Jurisdiction)
 		}
 		series = data.GetDataSeries(jurisdiction, sample)
-		series.AppendSample(sample)
+		id := 0
+		if sample.Jurisdiction != nil {
+			id = sample.Jurisdiction.Id()
+		}
+		series.samples[id] = append(series.samples[id], sample)
 	}
 	for _, series := range data.Series {
+		for _, sample := range series.fillGaps(data.Last) {
+			series.AppendSample(sample)
+		}
 		if series.Current != nil {
-			series.Current.NewCount = series.Current.Count - series.Cases
-			series.Current.NewDeceased = series.Current.Deceased - series.Deaths
+			series.closeDataPoint()
 		}
 	}
 	data.Last = data.Last.AddDate(0, 0, 1)
@@ -377,6 +487,73 @@ func (data *CasesChartData) BuildSeries() (err error) {
 	return
 }
 
+func (series *DataSeries) fillGaps(last time.Time) (ret []*Sample) {
+	ret = make([]*Sample, 0)
+	for _, samples := range series.samples {
+		for ix, sample := range samples {
+			ret = append(ret, sample)
+			var next *Sample
+			if ix+1 < len(samples) {
+				next = samples[ix+1]
+			}
+			ret = append(ret, series.ChartData.gapSamples(sample, next, last)...)
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].Date.Before(ret[j].Date)
+	})
+	return
+}
+
+// maxTrailingCarry covers late reports without keeping jurisdictions that
+// stopped reporting in the chart.
+const maxTrailingCarry = 3
+
+// gapSamples fills the days between prev and next, which is nil if prev is the
+// last sample of its jurisdiction.
+func (data *CasesChartData) gapSamples(prev *Sample, next *Sample, last time.Time) (filled []*Sample) {
+	end := last.AddDate(0, 0, 1)
+	switch {
+	case data.GapPolicy == GapLeaveNull:
+		return nil
+	case next != nil:
+		end = next.Date
+	case data.GapPolicy == GapInterpolate:
+		return nil
+	default:
+		if limit := prev.Date.AddDate(0, 0, maxTrailingCarry+1); limit.Before(end) {
+			end = limit
+		}
+	}
+	days := int(end.Sub(prev.Date).Hours()/24 + 0.5)
+	previous := prev
+	for d, ix := prev.Date.AddDate(0, 0, 1), 1; d.Before(end); d, ix = d.AddDate(0, 0, 1), ix+1 {
+		s := &Sample{Jurisdiction: prev.Jurisdiction, Date: d, filled: true}
+		s.copyMetrics(prev)
+		s.Confirmed, s.Deceased, s.Recovered = prev.Confirmed, prev.Deceased, prev.Recovered
+		if data.GapPolicy == GapInterpolate {
+			interpolate := func(from int, to int) int {
+				return from + int(math.Round(float64((to-from)*ix)/float64(days)))
+			}
+			s.Confirmed = interpolate(prev.Confirmed, next.Confirmed)
+			s.Deceased = interpolate(prev.Deceased, next.Deceased)
+			s.Recovered = interpolate(prev.Recovered, next.Recovered)
+			s.NewConfirmed, _ = delta(s.Confirmed, previous.Confirmed)
+			s.NewDeceased, _ = delta(s.Deceased, previous.Deceased)
+			s.NewRecovered, _ = delta(s.Recovered, previous.Recovered)
+		}
+		filled = append(filled, s)
+		previous = s
+	}
+	if next != nil && data.GapPolicy == GapInterpolate && len(filled) > 0 {
+		// The interpolated samples take their part of the daily numbers
+		next.NewConfirmed, _ = delta(next.Confirmed, previous.Confirmed)
+		next.NewDeceased, _ = delta(next.Deceased, previous.Deceased)
+		next.NewRecovered, _ = delta(next.Recovered, previous.Recovered)
+	}
+	return
+}
+
 func MakeCasesChartSeries(series *DataSeries, which int, chartType string, regression bool) (chartSeries *CasesChartSeries) {
 	chartSeries = new(CasesChartSeries)
 	chartSeries.Data = nil
@@ -391,20 +568,27 @@ func MakeCasesChartSeries(series *DataSeries, which int, chartType string, regre
 	return chartSeries
 }
 
-var subject = []string{"Confirmed", "Deceased"}
+var subject = []string{"Confirmed", "Deceased", "", "Recovered", "Active"}
+
+func (series *CasesChartSeries) Subject() string {
+	if series.Which == ChartDataMetric {
+		return series.DataSeries.ChartData.Metric.Label
+	}
+	return subject[series.Which]
+}
 
 func (series *CasesChartSeries) Label(code string) string {
 	switch series.ChartType {
 	case ChartTypeRelative:
-		return fmt.Sprintf("#%s/mio %s", subject[series.Which], code)
+		return fmt.Sprintf("#%s/mio %s", series.Subject(), code)
 	case ChartTypeSuppress:
 		return ""
 	case ChartTypeDaily:
-		return fmt.Sprintf("#Newly %s %s", subject[series.Which], code)
+		return fmt.Sprintf("#Newly %s %s", series.Subject(), code)
 	case ChartTypeRollingAvg:
-		return fmt.Sprintf("7 day rolling avg #newly %s %s", subject[series.Which], code)
+		return fmt.Sprintf("7 day rolling avg #newly %s %s", series.Subject(), code)
 	default:
-		return fmt.Sprintf("#%s %s", subject[series.Which], code)
+		return fmt.Sprintf("#%s %s", series.Subject(), code)
 	}
 }
 
@@ -446,6 +630,46 @@ func (series *CasesChartSeries) Append(ix int) {
 	}
 }
 
+// appendSeries marks the days filled in by the gap policy with dots in a
+// separate series.
+func (data *CasesChartData) appendSeries(ts chart.TimeSeries, filled []bool, missing []bool) chart.TimeSeries {
+	keep := filled
+	if data.GapPolicy == GapLeaveNull {
+		keep = make([]bool, len(missing))
+		for ix := range missing {
+			keep[ix] = !missing[ix]
+		}
+	}
+	xValues := make([]time.Time, 0)
+	yValues := make([]float64, 0)
+	for ix := range ts.XValues {
+		if keep[ix] {
+			xValues = append(xValues, ts.XValues[ix])
+			yValues = append(yValues, ts.YValues[ix])
+		}
+	}
+	if data.GapPolicy == GapLeaveNull {
+		ts.XValues, ts.YValues = xValues, yValues
+		data.ChartSeries = append(data.ChartSeries, ts)
+		return ts
+	}
+	data.ChartSeries = append(data.ChartSeries, ts)
+	if len(xValues) > 0 {
+		data.ChartSeries = append(data.ChartSeries, chart.TimeSeries{
+			Name: ts.Name + " (filled)",
+			Style: chart.Style{
+				StrokeWidth: chart.Disabled,
+				DotWidth:    2,
+				DotColor:    ts.Style.StrokeColor,
+			},
+			YAxis:   ts.YAxis,
+			XValues: xValues,
+			YValues: yValues,
+		})
+	}
+	return ts
+}
+
 func (data *CasesChartData) BuildChart() (err error) {
 	data.ChartSeries = make([]chart.Series, 0)
 	sortedSeries := make([]*DataSeries, 0)
@@ -467,35 +691,59 @@ func (data *CasesChartData) BuildChart() (err error) {
 			if code == "" {
 				code = series.Jurisdiction.Alpha2
 			}
+			if code == "" {
+				code = series.Jurisdiction.Name
+			}
 		}
 		caseLabel := series.ConfirmedData.Label(code)
 		deathsLabel := series.DeceasedData.Label(code)
 		seriesIx := 0
+		filled := make([]bool, data.Days)
+		missing := make([]bool, data.Days)
 		for d, ix := data.First, 0; d.Before(data.Last); d, ix = d.AddDate(0, 0, 1), ix+1 {
 			dateSeries[ix] = d
-			if !d.Before(series.DataPoints[seriesIx].Date) {
+			if seriesIx < len(series.DataPoints) && !d.Before(series.DataPoints[seriesIx].Date) {
+				filled[ix] = series.DataPoints[seriesIx].Filled
 				series.ConfirmedData.Current = series.DataPoints[seriesIx].Count
 				series.ConfirmedData.New = series.DataPoints[seriesIx].NewCount
 				series.DeceasedData.Current = series.DataPoints[seriesIx].Deceased
 				series.DeceasedData.New = series.DataPoints[seriesIx].NewDeceased
+				series.RecoveredData.Current = series.DataPoints[seriesIx].Recovered
+				series.RecoveredData.New = series.DataPoints[seriesIx].NewRecovered
+				series.ActiveData.Current = series.DataPoints[seriesIx].Active
+				series.ActiveData.New = series.DataPoints[seriesIx].NewActive
+				if series.MetricData != nil {
+					series.MetricData.Current = series.DataPoints[seriesIx].Metric
+					series.MetricData.New = series.DataPoints[seriesIx].NewMetric
+				}
 				seriesIx++
 			} else {
+				missing[ix] = true
 				series.ConfirmedData.New = 0
 				series.DeceasedData.New = 0
+				series.RecoveredData.New = 0
+				series.ActiveData.New = 0
+				if series.MetricData != nil {
+					series.MetricData.New = 0
+				}
 			}
 			series.ConfirmedData.Append(ix)
 			series.DeceasedData.Append(ix)
+			series.RecoveredData.Append(ix)
+			series.ActiveData.Append(ix)
+			if series.MetricData != nil {
+				series.MetricData.Append(ix)
+			}
 		}
 		if series.ConfirmedData.ChartType != ChartTypeSuppress {
-			confirmedTimeSeries := chart.TimeSeries{
+			confirmedTimeSeries := data.appendSeries(chart.TimeSeries{
 				Name: caseLabel,
 				Style: chart.Style{
 					StrokeColor: series.Color,
 				},
 				XValues: dateSeries,
 				YValues: series.ConfirmedData.Data,
-			}
-			data.ChartSeries = append(data.ChartSeries, confirmedTimeSeries)
+			}, filled, missing)
 
 			if series.ConfirmedData.Regression {
 				data.ChartSeries = append(data.ChartSeries, &chart.PolynomialRegressionSeries{
@@ -516,7 +764,7 @@ func (data *CasesChartData) BuildChart() (err error) {
 				yAxis = chart.YAxisSecondary
 				strokeDashArray = []float64{5.0, 5.0}
 			}
-			deceasedTimeSeries := chart.TimeSeries{
+			data.appendSeries(chart.TimeSeries{
 				Name: deathsLabel,
 				Style: chart.Style{
 					StrokeColor:     series.Color,
@@ -525,8 +773,43 @@ func (data *CasesChartData) BuildChart() (err error) {
 				YAxis:   yAxis,
 				XValues: dateSeries,
 				YValues: series.DeceasedData.Data,
+			}, filled, missing)
+		}
+		for _, caseSeries := range []struct {
+			data            *CasesChartSeries
+			strokeDashArray []float64
+		}{
+			{series.RecoveredData, []float64{8.0, 4.0}},
+			{series.ActiveData, []float64{8.0, 2.0, 2.0, 2.0}},
+		} {
+			if caseSeries.data.ChartType == ChartTypeSuppress {
+				continue
+			}
+			data.appendSeries(chart.TimeSeries{
+				Name: caseSeries.data.Label(code),
+				Style: chart.Style{
+					StrokeColor:     series.Color,
+					StrokeDashArray: caseSeries.strokeDashArray,
+				},
+				XValues: dateSeries,
+				YValues: caseSeries.data.Data,
+			}, filled, missing)
+		}
+		if series.MetricData != nil {
+			yAxis := chart.YAxisPrimary
+			if series.ConfirmedData.ChartType != ChartTypeSuppress {
+				yAxis = chart.YAxisSecondary
 			}
-			data.ChartSeries = append(data.ChartSeries, deceasedTimeSeries)
+			data.appendSeries(chart.TimeSeries{
+				Name: series.MetricData.Label(code),
+				Style: chart.Style{
+					StrokeColor:     series.Color,
+					StrokeDashArray: []float64{1.0, 3.0},
+				},
+				YAxis:   yAxis,
+				XValues: dateSeries,
+				YValues: series.MetricData.Data,
+			}, filled, missing)
 		}
 	}
 	return
@@ -0,0 +1,67 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2020 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGapSamplesCarryForward(t *testing.T) {
+	data := &CasesChartData{GapPolicy: GapCarryForward}
+	day := func(n int) time.Time {
+		return time.Date(2020, 4, n, 0, 0, 0, 0, time.UTC)
+	}
+	prev := &Sample{Date: day(1), Confirmed: 10}
+
+	// Interior gaps are filled up to the next sample
+	if filled := data.gapSamples(prev, &Sample{Date: day(10), Confirmed: 20}, day(30)); len(filled) != 8 {
+		t.Errorf("interior gap of 8 days filled with %d samples", len(filled))
+	}
+	// A late report is filled up to the end of the chart
+	if filled := data.gapSamples(prev, nil, day(3)); len(filled) != 2 || !filled[1].Date.Equal(day(3)) {
+		t.Errorf("trailing gap of 2 days filled with %d samples", len(filled))
+	}
+	// A jurisdiction that stopped reporting is not carried to the end
+	filled := data.gapSamples(prev, nil, day(30))
+	if len(filled) != maxTrailingCarry {
+		t.Fatalf("trailing gap of 29 days filled with %d samples, expected %d", len(filled), maxTrailingCarry)
+	}
+	for _, s := range filled {
+		if s.Confirmed != 10 || s.NewConfirmed != 0 {
+			t.Errorf("carried sample for %v: %d confirmed, %d new", s.Date, s.Confirmed, s.NewConfirmed)
+		}
+	}
+}
+
+func TestSeriesChartType(t *testing.T) {
+	for value, expected := range map[string]string{
+		"":                  ChartTypeSuppress,
+		"NONE":              ChartTypeSuppress,
+		ChartTypeSuppress:   ChartTypeSuppress,
+		ChartTypeMortality:  ChartTypeSuppress,
+		ChartTypeAbsolute:   ChartTypeAbsolute,
+		ChartTypeRollingAvg: ChartTypeRollingAvg,
+	} {
+		if got := seriesChartType(value); got != expected {
+			t.Errorf("seriesChartType(%q) = %q, expected %q", value, got, expected)
+		}
+	}
+}
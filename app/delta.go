@@ -0,0 +1,188 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2020 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package app
+
+import (
+	"database/sql"
+	"github.com/JanDeVisser/grumble"
+	"time"
+)
+
+func (sample *Sample) IsCorrection() bool {
+	return sample.ConfirmedCorrection < 0 || sample.DeceasedCorrection < 0 || sample.RecoveredCorrection < 0
+}
+
+// delta returns a total that went down as a correction instead of a negative
+// increase.
+func delta(total int, previous int) (increase int, correction int) {
+	if total < previous {
+		return 0, total - previous
+	}
+	return total - previous, 0
+}
+
+func (sample *Sample) setDeltas(previous *Sample) (changed bool) {
+	if previous == nil {
+		previous = &Sample{}
+	}
+	newConfirmed, confirmedCorrection := delta(sample.Confirmed, previous.Confirmed)
+	newDeceased, deceasedCorrection := delta(sample.Deceased, previous.Deceased)
+	newRecovered, recoveredCorrection := delta(sample.Recovered, previous.Recovered)
+	changed = newConfirmed != sample.NewConfirmed || confirmedCorrection != sample.ConfirmedCorrection ||
+		newDeceased != sample.NewDeceased || deceasedCorrection != sample.DeceasedCorrection ||
+		newRecovered != sample.NewRecovered || recoveredCorrection != sample.RecoveredCorrection
+	sample.NewConfirmed, sample.ConfirmedCorrection = newConfirmed, confirmedCorrection
+	sample.NewDeceased, sample.DeceasedCorrection = newDeceased, deceasedCorrection
+	sample.NewRecovered, sample.RecoveredCorrection = newRecovered, recoveredCorrection
+	return
+}
+
+func samplesByJurisdiction(mgr *grumble.EntityManager, d time.Time) (ret map[int]*Sample, err error) {
+	ret = make(map[int]*Sample)
+	q := mgr.MakeQuery(Sample{})
+	q.AddFilter("Date", d)
+	results, err := q.Execute()
+	if err != nil {
+		return
+	}
+	for _, row := range results {
+		s := row[0].(*Sample)
+		if s.Jurisdiction != nil {
+			ret[s.Jurisdiction.Id()] = s
+		}
+	}
+	return
+}
+
+// previousSamples returns the most recent sample before the date, however long
+// ago, so the daily numbers after a gap cover the whole gap.
+func previousSamples(mgr *grumble.EntityManager, d time.Time, jurisdictions map[int]*Jurisdiction) (ret map[int]*Sample, err error) {
+	ret, err = samplesByJurisdiction(mgr, d.AddDate(0, 0, -1))
+	if err != nil {
+		return
+	}
+	missing := make([]grumble.Persistable, 0)
+	for id, j := range jurisdictions {
+		if _, ok := ret[id]; !ok {
+			missing = append(missing, j)
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+	q := mgr.MakeQuery(Sample{})
+	q.AddCondition(&grumble.References{
+		Column:     "Jurisdiction",
+		References: missing,
+	})
+	q.AddSort(grumble.Sort{Column: "Date", Direction: "DESC"})
+	results, err := q.Execute()
+	if err != nil {
+		return
+	}
+	for _, row := range results {
+		s := row[0].(*Sample)
+		if s.Jurisdiction == nil || !s.Date.Before(d) {
+			continue
+		}
+		if _, ok := ret[s.Jurisdiction.Id()]; !ok {
+			ret[s.Jurisdiction.Id()] = s
+		}
+	}
+	return
+}
+
+func setImportedDeltas(mgr *grumble.EntityManager, d time.Time, samples map[string]*Sample) (err error) {
+	jurisdictions := make(map[int]*Jurisdiction)
+	var collect func(samples map[string]*Sample)
+	collect = func(samples map[string]*Sample) {
+		for _, s := range samples {
+			jurisdictions[s.Jurisdiction.Id()] = s.Jurisdiction
+			collect(s.subs)
+		}
+	}
+	collect(samples)
+	previous, err := previousSamples(mgr, d, jurisdictions)
+	if err != nil {
+		return
+	}
+	var set func(samples map[string]*Sample)
+	set = func(samples map[string]*Sample) {
+		for _, s := range samples {
+			s.setDeltas(previous[s.Jurisdiction.Id()])
+			set(s.subs)
+		}
+	}
+	set(samples)
+	return
+}
+
+func RecomputeDeltas(mgr *grumble.EntityManager, d time.Time) (count int, err error) {
+	current, err := samplesByJurisdiction(mgr, d)
+	if err != nil || len(current) == 0 {
+		return
+	}
+	jurisdictions := make(map[int]*Jurisdiction)
+	for id, s := range current {
+		jurisdictions[id] = s.Jurisdiction
+	}
+	previous, err := previousSamples(mgr, d, jurisdictions)
+	if err != nil {
+		return
+	}
+	err = mgr.TX(func(db *sql.DB) (err error) {
+		for id, s := range current {
+			if !s.setDeltas(previous[id]) {
+				continue
+			}
+			if err = mgr.Put(s); err != nil {
+				return
+			}
+			count++
+		}
+		return
+	})
+	return
+}
+
+func RecomputeAllDeltas(mgr *grumble.EntityManager, from *time.Time, to *time.Time, progress ImportProgress) (err error) {
+	oldest, newest, err := OldestAndNewestSample(mgr)
+	if err != nil {
+		return
+	}
+	start, end := utcDate(oldest), utcDate(newest).AddDate(0, 0, 1)
+	if from != nil {
+		start = utcDate(*from)
+	}
+	if to != nil {
+		end = utcDate(*to)
+	}
+	total := int(end.Sub(start).Hours() / 24)
+	for d, ix := start, 1; d.Before(end); d, ix = d.AddDate(0, 0, 1), ix+1 {
+		var count int
+		if count, err = RecomputeDeltas(mgr, d); err != nil {
+			return
+		}
+		if progress != nil {
+			progress(d, ix, total, count, 0)
+		}
+	}
+	return
+}
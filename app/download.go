@@ -0,0 +1,148 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2020 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package app
+
+import (
+	"context"
+	"errors"
+	"github.com/JanDeVisser/grumble/handler"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Downloader retries failed downloads up to Retries times, doubling the wait
+// between attempts starting at Backoff.
+type Downloader struct {
+	Client  *http.Client
+	Retries int
+	Backoff time.Duration
+}
+
+func configSeconds(name string, def float64) time.Duration {
+	secs := def
+	if secsIface, ok := handler.GetAppConfig()[name]; ok {
+		secs = secsIface.(float64)
+	}
+	return time.Duration(secs * float64(time.Second))
+}
+
+func MakeDownloader() *Downloader {
+	retries := 3
+	if retriesIface, ok := handler.GetAppConfig()["downloadretries"]; ok {
+		retries = int(retriesIface.(float64))
+	}
+	return &Downloader{
+		Client:  &http.Client{Timeout: configSeconds("downloadtimeout", 60)},
+		Retries: retries,
+		Backoff: configSeconds("downloadbackoff", 2),
+	}
+}
+
+func retryable(err error) bool {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode >= 500 || httpErr.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
+type Download struct {
+	Data         []byte
+	ETag         string
+	LastModified string
+	NotModified  bool
+}
+
+func (dl *Downloader) Get(ctx context.Context, url string) (data []byte, err error) {
+	download, err := dl.GetIfModified(ctx, url, "", "")
+	if err != nil {
+		return
+	}
+	return download.Data, nil
+}
+
+// GetIfModified sends the ETag and Last-Modified time, if not empty, in a
+// conditional request. A nil Downloader uses the configured defaults.
+func (dl *Downloader) GetIfModified(ctx context.Context, url string, etag string, lastModified string) (download *Download, err error) {
+	if dl == nil {
+		dl = MakeDownloader()
+	}
+	delay := dl.Backoff
+	for attempt := 0; ; attempt++ {
+		download, err = dl.get(ctx, url, etag, lastModified)
+		if err == nil || attempt >= dl.Retries || ctx.Err() != nil || !retryable(err) {
+			return
+		}
+		log.Printf("Downloading %s failed, retrying in %v: %v", url, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+func (dl *Downloader) get(ctx context.Context, url string, etag string, lastModified string) (download *Download, err error) {
+	log.Printf("Downloading %s", url)
+	client := dl.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer func() {
+		e := resp.Body.Close()
+		if err == nil {
+			err = e
+		}
+	}()
+	var data []byte
+	if data, err = ioutil.ReadAll(resp.Body); err != nil {
+		return
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		download = &Download{Data: data}
+	case http.StatusNotModified:
+		download = &Download{NotModified: true}
+	default:
+		return nil, &HTTPError{URL: url, StatusCode: resp.StatusCode, Body: string(data)}
+	}
+	download.ETag = resp.Header.Get("ETag")
+	download.LastModified = resp.Header.Get("Last-Modified")
+	return
+}
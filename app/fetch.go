@@ -0,0 +1,133 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2020 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"github.com/JanDeVisser/grumble/handler"
+	"time"
+)
+
+type fetchedReport struct {
+	Date      time.Time
+	Data      []byte
+	Hash      string
+	Unchanged bool
+	Records   []*SampleRecord
+	FetchErr  error
+	ParseErr  error
+}
+
+type fetchRequest struct {
+	Date     time.Time
+	Revising bool
+	Hash     string
+}
+
+// fetchReport doesn't touch the database, so reports can be fetched in
+// parallel.
+func fetchReport(ctx context.Context, source SampleSource, req fetchRequest) (report *fetchedReport) {
+	report = &fetchedReport{Date: req.Date}
+	if req.Revising {
+		if cache, ok := source.(CachingSource); ok {
+			cache.Invalidate(req.Date)
+		}
+	}
+	if report.Data, report.FetchErr = source.Fetch(ctx, req.Date); report.FetchErr != nil {
+		return
+	}
+	report.Hash = fmt.Sprintf("%x", sha256.Sum256(report.Data))
+	if req.Revising && report.Hash == req.Hash {
+		report.Unchanged = true
+		return
+	}
+	report.Records, report.ParseErr = source.Parse(req.Date, report.Data)
+	return
+}
+
+func importConcurrency() int {
+	if concurrencyIface, ok := handler.GetAppConfig()["importconcurrency"]; ok {
+		if concurrency := int(concurrencyIface.(float64)); concurrency > 0 {
+			return concurrency
+		}
+	}
+	return 4
+}
+
+// reportFetcher fetches reports with a bounded number of workers and hands
+// them out in date order. It stays at most twice the number of workers ahead
+// of the import.
+type reportFetcher struct {
+	reports []chan *fetchedReport
+	slots   chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func startReportFetcher(source SampleSource, requests []fetchRequest, concurrency int) (f *reportFetcher) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	f = &reportFetcher{
+		reports: make([]chan *fetchedReport, len(requests)),
+		slots:   make(chan struct{}, 2*concurrency),
+	}
+	f.ctx, f.cancel = context.WithCancel(context.Background())
+	for ix := range f.reports {
+		f.reports[ix] = make(chan *fetchedReport, 1)
+	}
+	jobs := make(chan int)
+	go func() {
+		defer close(jobs)
+		for ix := range requests {
+			select {
+			case f.slots <- struct{}{}:
+			case <-f.ctx.Done():
+				return
+			}
+			select {
+			case jobs <- ix:
+			case <-f.ctx.Done():
+				return
+			}
+		}
+	}()
+	for w := 0; w < concurrency; w++ {
+		go func() {
+			for ix := range jobs {
+				f.reports[ix] <- fetchReport(f.ctx, source, requests[ix])
+			}
+		}()
+	}
+	return
+}
+
+// report must be called in date order.
+func (f *reportFetcher) report(ix int) (report *fetchedReport) {
+	report = <-f.reports[ix]
+	<-f.slots
+	return
+}
+
+func (f *reportFetcher) stop() {
+	f.cancel()
+}
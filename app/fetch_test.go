@@ -0,0 +1,176 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2020 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testDownloader(retries int, backoff time.Duration, timeout time.Duration) *Downloader {
+	return &Downloader{
+		Client:  &http.Client{Timeout: timeout},
+		Retries: retries,
+		Backoff: backoff,
+	}
+}
+
+func TestReportFetcherKeepsDateOrder(t *testing.T) {
+	const days = 8
+	first := time.Date(2020, 4, 1, 0, 0, 0, 0, time.UTC)
+	var lock sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d, err := time.Parse("01-02-2006.csv", strings.TrimPrefix(r.URL.Path, "/"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		lock.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		lock.Unlock()
+		// Earlier reports take longer, so they finish out of order.
+		day := int(d.Sub(first).Hours() / 24)
+		time.Sleep(time.Duration(days-day) * 10 * time.Millisecond)
+		lock.Lock()
+		inFlight--
+		lock.Unlock()
+		_, _ = fmt.Fprintf(w, "Country_Region,Confirmed,Deaths\nNetherlands,%d,0\n", day)
+	}))
+	defer server.Close()
+
+	source := &JHUSource{BaseURL: server.URL, Downloader: testDownloader(0, 0, 5*time.Second)}
+	requests := make([]fetchRequest, days)
+	for ix := range requests {
+		requests[ix] = fetchRequest{Date: first.AddDate(0, 0, ix)}
+	}
+	fetcher := startReportFetcher(source, requests, 4)
+	defer fetcher.stop()
+	for ix, req := range requests {
+		report := fetcher.report(ix)
+		if report.FetchErr != nil || report.ParseErr != nil {
+			t.Fatalf("report %d: fetch error %v, parse error %v", ix, report.FetchErr, report.ParseErr)
+		}
+		if !report.Date.Equal(req.Date) {
+			t.Fatalf("report %d is for %v, expected %v", ix, report.Date, req.Date)
+		}
+		if len(report.Records) != 1 || report.Records[0].Confirmed != ix {
+			t.Fatalf("report %d has records %+v", ix, report.Records)
+		}
+	}
+	if maxInFlight < 2 {
+		t.Errorf("reports were fetched one at a time")
+	}
+}
+
+func TestDownloaderRetries(t *testing.T) {
+	for _, status := range []int{http.StatusServiceUnavailable, http.StatusTooManyRequests} {
+		var hits int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&hits, 1) <= 2 {
+				w.WriteHeader(status)
+				return
+			}
+			_, _ = w.Write([]byte("ok"))
+		}))
+		start := time.Now()
+		data, err := testDownloader(3, 20*time.Millisecond, 5*time.Second).Get(context.Background(), server.URL)
+		elapsed := time.Since(start)
+		server.Close()
+		if err != nil || string(data) != "ok" {
+			t.Fatalf("status %d: got %q, %v", status, data, err)
+		}
+		if hits != 3 {
+			t.Errorf("status %d: %d requests, expected 3", status, hits)
+		}
+		// Backs off 20ms, then 40ms.
+		if elapsed < 60*time.Millisecond {
+			t.Errorf("status %d: retried after %v, expected backoff of at least 60ms", status, elapsed)
+		}
+	}
+}
+
+func TestDownloaderDoesNotRetryNotFound(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+	_, err := testDownloader(3, time.Millisecond, 5*time.Second).Get(context.Background(), server.URL)
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("got error %v, expected a 404 HTTPError", err)
+	}
+	if retryable(err) {
+		t.Errorf("404 is retryable")
+	}
+	if hits != 1 {
+		t.Errorf("%d requests, expected 1", hits)
+	}
+}
+
+func TestDownloaderCancelStopsBackoff(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := testDownloader(3, time.Minute, 5*time.Second).Get(ctx, server.URL)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, expected %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("cancelling took %v", elapsed)
+	}
+}
+
+func TestDownloaderTimeout(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+	start := time.Now()
+	_, err := testDownloader(0, 0, 50*time.Millisecond).Get(context.Background(), server.URL)
+	if err == nil {
+		t.Fatalf("request did not time out")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("timed out after %v", elapsed)
+	}
+}
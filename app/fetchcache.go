@@ -0,0 +1,327 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2020 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/JanDeVisser/grumble/handler"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FetchCache keeps copies of downloaded documents in a directory. Copies never
+// expire if MaxAge is negative.
+type FetchCache struct {
+	Dir    string
+	MaxAge time.Duration
+}
+
+type CacheEntry struct {
+	Name         string    `json:"name"`
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	SHA256       string    `json:"sha256"`
+	Size         int       `json:"size"`
+	Fetched      time.Time `json:"fetched"`
+	Revalidate   bool      `json:"revalidate,omitempty"`
+	Expired      bool      `json:"-"`
+}
+
+const metaSuffix = ".meta"
+
+func (entry *CacheEntry) ShortHash() string {
+	if len(entry.SHA256) > 12 {
+		return entry.SHA256[:12]
+	}
+	return entry.SHA256
+}
+
+func MakeFetchCache() *FetchCache {
+	dir := "cache"
+	if dirIface, ok := handler.GetAppConfig()["cachedir"]; ok {
+		dir = dirIface.(string)
+	}
+	return &FetchCache{Dir: dir, MaxAge: configSeconds("cachemaxage", -1)}
+}
+
+func (c *FetchCache) path(name string) (path string, err error) {
+	if name == "" || filepath.Base(name) != name || strings.HasPrefix(name, ".") || strings.HasSuffix(name, metaSuffix) {
+		return "", fmt.Errorf("invalid cache entry name %q", name)
+	}
+	return filepath.Join(c.Dir, name), nil
+}
+
+func (c *FetchCache) expired(entry *CacheEntry) bool {
+	return entry.Revalidate || (c.MaxAge >= 0 && time.Since(entry.Fetched) > c.MaxAge)
+}
+
+func (c *FetchCache) readEntry(name string) (entry *CacheEntry, err error) {
+	path, err := c.path(name)
+	if err != nil {
+		return
+	}
+	data, err := ioutil.ReadFile(path + metaSuffix)
+	if err != nil {
+		return
+	}
+	entry = &CacheEntry{}
+	if err = json.Unmarshal(data, entry); err != nil {
+		return nil, fmt.Errorf("cache entry %q: %v", name, err)
+	}
+	entry.Name = name
+	entry.Expired = c.expired(entry)
+	return
+}
+
+// read returns a nil entry if the cache doesn't have the document.
+func (c *FetchCache) read(name string) (entry *CacheEntry, data []byte, err error) {
+	if entry, err = c.readEntry(name); os.IsNotExist(err) {
+		return nil, nil, nil
+	} else if err != nil {
+		return
+	}
+	path, _ := c.path(name)
+	if data, err = ioutil.ReadFile(path); err != nil {
+		return nil, nil, err
+	}
+	if hash := fmt.Sprintf("%x", sha256.Sum256(data)); hash != entry.SHA256 {
+		return nil, nil, fmt.Errorf("cache entry %q is corrupt: hash is %s, expected %s", name, hash, entry.SHA256)
+	}
+	return
+}
+
+// writeFile replaces the file so concurrent readers never see a partial write.
+func writeFile(path string, data []byte) (err error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(data)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return
+}
+
+func (c *FetchCache) writeEntry(entry *CacheEntry) (err error) {
+	path, err := c.path(entry.Name)
+	if err != nil {
+		return
+	}
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return
+	}
+	return writeFile(path+metaSuffix, data)
+}
+
+func (c *FetchCache) write(entry *CacheEntry, data []byte) (err error) {
+	path, err := c.path(entry.Name)
+	if err != nil {
+		return
+	}
+	if err = os.MkdirAll(c.Dir, 0777); err != nil {
+		return
+	}
+	if err = writeFile(path, data); err != nil {
+		return
+	}
+	return c.writeEntry(entry)
+}
+
+// Get returns the cached copy of the document unless it expired, in which case
+// it is revalidated with a conditional request.
+func (c *FetchCache) Get(ctx context.Context, dl *Downloader, name string, url string) (data []byte, err error) {
+	entry, data, err := c.read(name)
+	if err != nil {
+		log.Printf("Error reading cached copy of %q: %v", name, err)
+		entry, data = nil, nil
+	}
+	if entry != nil && !entry.Expired {
+		log.Printf("Reading cached copy of %q", name)
+		return data, nil
+	}
+	var etag, lastModified string
+	if entry != nil && entry.URL == url {
+		etag, lastModified = entry.ETag, entry.LastModified
+	}
+	download, err := dl.GetIfModified(ctx, url, etag, lastModified)
+	if err != nil {
+		return nil, err
+	}
+	if download.NotModified {
+		if entry == nil {
+			return nil, fmt.Errorf("%s: not modified, but there is no cached copy of %q", url, name)
+		}
+		log.Printf("Cached copy of %q is up to date", name)
+		if download.ETag != "" {
+			entry.ETag = download.ETag
+		}
+		if download.LastModified != "" {
+			entry.LastModified = download.LastModified
+		}
+		entry.Fetched = time.Now()
+		entry.Revalidate = false
+		if e := c.writeEntry(entry); e != nil {
+			log.Printf("Error updating cache entry %q: %v", name, e)
+		}
+		return data, nil
+	}
+	entry = &CacheEntry{
+		Name:         name,
+		URL:          url,
+		ETag:         download.ETag,
+		LastModified: download.LastModified,
+		SHA256:       fmt.Sprintf("%x", sha256.Sum256(download.Data)),
+		Size:         len(download.Data),
+		Fetched:      time.Now(),
+	}
+	if e := c.write(entry, download.Data); e != nil {
+		log.Printf("Error caching %q: %v", name, e)
+	}
+	return download.Data, nil
+}
+
+func (c *FetchCache) Entries() (entries []*CacheEntry, err error) {
+	entries = make([]*CacheEntry, 0)
+	files, err := ioutil.ReadDir(c.Dir)
+	if os.IsNotExist(err) {
+		return entries, nil
+	} else if err != nil {
+		return
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), metaSuffix) {
+			continue
+		}
+		entry, e := c.readEntry(strings.TrimSuffix(f.Name(), metaSuffix))
+		if e != nil {
+			log.Printf("Error reading cache entry %q: %v", f.Name(), e)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	return
+}
+
+func (c *FetchCache) Expire(name string) (err error) {
+	entry, err := c.readEntry(name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return
+	}
+	entry.Revalidate = true
+	return c.writeEntry(entry)
+}
+
+func (c *FetchCache) Remove(name string) (err error) {
+	path, err := c.path(name)
+	if err != nil {
+		return
+	}
+	for _, p := range []string{path + metaSuffix, path} {
+		if e := os.Remove(p); e != nil && !os.IsNotExist(e) {
+			err = e
+		}
+	}
+	return
+}
+
+func (c *FetchCache) Clear() error {
+	return os.RemoveAll(c.Dir)
+}
+
+/* ================================================================================================================ */
+
+type FetchCacheContext struct {
+	Cache   *FetchCache
+	Entries []*CacheEntry
+}
+
+func (fcc *FetchCacheContext) MakeContext(req *handler.PlainRequest) (err error) {
+	data := make(map[string]interface{})
+	data["dir"] = fcc.Cache.Dir
+	data["maxage"] = fcc.Cache.MaxAge
+	data["entries"] = fcc.Entries
+	req.Data = data
+	req.Template = "html/cache/list.html"
+	return
+}
+
+func FetchCacheRequest(res http.ResponseWriter, req *http.Request) {
+	cache := MakeFetchCache()
+	if req.Method == http.MethodPost {
+		if req.FormValue("magic") != "DEADBEEF" {
+			http.Error(res, "Missing magic value", http.StatusInternalServerError)
+			return
+		}
+		var err error
+		switch req.FormValue("action") {
+		case "expire":
+			err = cache.Expire(req.FormValue("name"))
+		case "remove":
+			err = cache.Remove(req.FormValue("name"))
+		case "clear":
+			err = cache.Clear()
+		default:
+			http.Error(res, fmt.Sprintf("Invalid action %q", req.FormValue("action")), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(res, req, "/cache", http.StatusSeeOther)
+		return
+	}
+	entries, err := cache.Entries()
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if wantsJSON(req) {
+		res.Header().Set("Content-Type", "application/json")
+		if err = json.NewEncoder(res).Encode(entries); err != nil {
+			log.Printf("Error encoding cache entries: %v", err)
+		}
+		return
+	}
+	handler.ServePlainPage(res, req, &FetchCacheContext{Cache: cache, Entries: entries})
+}
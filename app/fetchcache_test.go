@@ -0,0 +1,64 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2020 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCacheEntryShortHash(t *testing.T) {
+	for hash, expected := range map[string]string{
+		"":               "",
+		"abc":            "abc",
+		"0123456789abcd": "0123456789ab",
+	} {
+		if got := (&CacheEntry{SHA256: hash}).ShortHash(); got != expected {
+			t.Errorf("ShortHash of %q is %q, expected %q", hash, got, expected)
+		}
+	}
+}
+
+func TestFetchCacheExpired(t *testing.T) {
+	old := &CacheEntry{Fetched: time.Now().Add(-48 * time.Hour)}
+	if (&FetchCache{MaxAge: -1}).expired(old) {
+		t.Errorf("entry expired with a negative max age")
+	}
+	if !(&FetchCache{MaxAge: 24 * time.Hour}).expired(old) {
+		t.Errorf("entry older than the max age didn't expire")
+	}
+	if !(&FetchCache{MaxAge: -1}).expired(&CacheEntry{Fetched: time.Now(), Revalidate: true}) {
+		t.Errorf("entry marked for revalidation didn't expire")
+	}
+}
+
+func TestFetchCacheNotModifiedWithoutCopy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusNotModified)
+	}))
+	defer server.Close()
+	cache := &FetchCache{Dir: t.TempDir(), MaxAge: -1}
+	if _, err := cache.Get(context.Background(), &Downloader{}, "report.csv", server.URL); err == nil {
+		t.Errorf("304 without a cached copy didn't fail")
+	}
+}
@@ -0,0 +1,437 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2020 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package app
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/JanDeVisser/grumble"
+	"github.com/JanDeVisser/grumble/handler"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	RuleNonMonotonic = "non-monotonic"
+	RuleSumMismatch  = "sum-mismatch"
+	RuleOutlier      = "outlier"
+	RuleMissingDay   = "missing-day"
+)
+
+var FindingRules = []string{
+	RuleNonMonotonic,
+	RuleSumMismatch,
+	RuleOutlier,
+	RuleMissingDay,
+}
+
+// Finding is a violation of a data quality rule. Findings for missing days
+// have no sample.
+type Finding struct {
+	grumble.Key
+	Jurisdiction *Jurisdiction
+	Sample       *Sample
+	Date         time.Time
+	Rule         string
+	Field        string
+	Value        int
+	Expected     int
+	Message      string
+	Timestamp    time.Time
+}
+
+// outlierMinimum keeps jurisdictions with a handful of cases from being
+// flagged.
+const outlierMinimum = 100
+
+func outlierSigma() float64 {
+	if sigmaIface, ok := handler.GetAppConfig()["outliersigma"]; ok {
+		return sigmaIface.(float64)
+	}
+	return 5.0
+}
+
+func outlierWindow() int {
+	if windowIface, ok := handler.GetAppConfig()["outlierwindow"]; ok {
+		return int(windowIface.(float64))
+	}
+	return 28
+}
+
+// missingDays is the number of days after which a jurisdiction without samples
+// is assumed to be no longer reported.
+func missingDays() int {
+	if daysIface, ok := handler.GetAppConfig()["missingdays"]; ok {
+		return int(daysIface.(float64))
+	}
+	return 7
+}
+
+type dailyHistory struct {
+	confirmed []int
+	deceased  []int
+}
+
+func (h *dailyHistory) push(s *Sample, window int) {
+	h.confirmed = append(h.confirmed, s.NewConfirmed)
+	h.deceased = append(h.deceased, s.NewDeceased)
+	if len(h.confirmed) > window {
+		h.confirmed = h.confirmed[1:]
+		h.deceased = h.deceased[1:]
+	}
+}
+
+func isOutlier(value int, history []int, sigma float64) (outlier bool, mean float64) {
+	if len(history) < 7 {
+		return
+	}
+	for _, v := range history {
+		mean += float64(v)
+	}
+	mean /= float64(len(history))
+	variance := 0.0
+	for _, v := range history {
+		variance += (float64(v) - mean) * (float64(v) - mean)
+	}
+	stddev := math.Sqrt(variance / float64(len(history)))
+	deviation := math.Abs(float64(value) - mean)
+	outlier = deviation > outlierMinimum && deviation > sigma*stddev
+	return
+}
+
+// sampleChecker applies the data quality rules to the samples of consecutive
+// dates.
+type sampleChecker struct {
+	mgr         *grumble.EntityManager
+	sigma       float64
+	window      int
+	missingDays int
+	until       time.Time
+	lastSeen    map[int]*Sample
+	history     map[int]*dailyHistory
+}
+
+func makeSampleChecker(mgr *grumble.EntityManager) *sampleChecker {
+	return &sampleChecker{
+		mgr:         mgr,
+		sigma:       outlierSigma(),
+		window:      outlierWindow(),
+		missingDays: missingDays(),
+		lastSeen:    make(map[int]*Sample),
+		history:     make(map[int]*dailyHistory),
+	}
+}
+
+func jurisdictionName(j *Jurisdiction) string {
+	if cached := Registry.ById(j.Id()); cached != nil {
+		return cached.Name
+	}
+	return fmt.Sprintf("jurisdiction %d", j.Id())
+}
+
+func (c *sampleChecker) finding(s *Sample, j *Jurisdiction, d time.Time, rule string, field string, value int, expected int, format string, args ...interface{}) *Finding {
+	return &Finding{
+		Jurisdiction: j,
+		Sample:       s,
+		Date:         d,
+		Rule:         rule,
+		Field:        field,
+		Value:        value,
+		Expected:     expected,
+		Message:      fmt.Sprintf("%s: %s", jurisdictionName(j), fmt.Sprintf(format, args...)),
+	}
+}
+
+func (c *sampleChecker) check(d time.Time) (findings []*Finding, err error) {
+	q := c.mgr.MakeQuery(Sample{})
+	q.AddFilter("Date", d)
+	results, err := q.Execute()
+	if err != nil {
+		return
+	}
+	samples := make([]*Sample, 0, len(results))
+	for _, row := range results {
+		samples = append(samples, row[0].(*Sample))
+	}
+	return c.checkSamples(d, samples), nil
+}
+
+func (c *sampleChecker) checkSamples(d time.Time, samples []*Sample) (findings []*Finding) {
+	findings = make([]*Finding, 0)
+	if len(samples) == 0 {
+		// Dates after the newest sample are not imported yet
+		if len(c.lastSeen) > 0 && d.Before(c.until) {
+			findings = append(findings, &Finding{Date: d, Rule: RuleMissingDay, Message: "No samples for any jurisdiction"})
+		}
+		c.expire(d, nil)
+		return
+	}
+	current := make(map[int]*Sample)
+	children := make(map[int][]*Sample)
+	for _, s := range samples {
+		if s.Jurisdiction == nil {
+			continue
+		}
+		current[s.Jurisdiction.Id()] = s
+		if parent := s.Parent(); parent != nil && parent != grumble.ZeroKey {
+			children[parent.Id()] = append(children[parent.Id()], s)
+		}
+	}
+
+	for id, s := range current {
+		j := s.Jurisdiction
+		for _, field := range []struct {
+			name       string
+			total      int
+			correction int
+		}{
+			{"Confirmed", s.Confirmed, s.ConfirmedCorrection},
+			{"Deceased", s.Deceased, s.DeceasedCorrection},
+			{"Recovered", s.Recovered, s.RecoveredCorrection},
+		} {
+			if field.correction < 0 {
+				findings = append(findings, c.finding(s, j, d, RuleNonMonotonic, field.name, field.total, field.total-field.correction,
+					"%s went down from %d to %d", field.name, field.total-field.correction, field.total))
+			}
+		}
+
+		// The numbers not attributed to a subdivision are counted in the
+		// sample but in none of its children.
+		if kids := children[s.Id()]; len(kids) > 0 {
+			confirmed, deceased := s.UnassignedConfirmed, s.UnassignedDeceased
+			for _, kid := range kids {
+				confirmed += kid.Confirmed
+				deceased += kid.Deceased
+			}
+			if confirmed != s.Confirmed {
+				findings = append(findings, c.finding(s, j, d, RuleSumMismatch, "Confirmed", s.Confirmed, confirmed,
+					"%d confirmed cases, but its %d subdivisions and %d unassigned cases add up to %d",
+					s.Confirmed, len(kids), s.UnassignedConfirmed, confirmed))
+			}
+			if deceased != s.Deceased {
+				findings = append(findings, c.finding(s, j, d, RuleSumMismatch, "Deceased", s.Deceased, deceased,
+					"%d deaths, but its %d subdivisions and %d unassigned deaths add up to %d",
+					s.Deceased, len(kids), s.UnassignedDeceased, deceased))
+			}
+		}
+
+		h, ok := c.history[id]
+		if !ok {
+			h = &dailyHistory{}
+			c.history[id] = h
+		}
+		if outlier, mean := isOutlier(s.NewConfirmed, h.confirmed, c.sigma); outlier {
+			findings = append(findings, c.finding(s, j, d, RuleOutlier, "NewConfirmed", s.NewConfirmed, int(math.Round(mean)),
+				"%d new cases, against an average of %.0f over the %d days before", s.NewConfirmed, mean, len(h.confirmed)))
+		}
+		if outlier, mean := isOutlier(s.NewDeceased, h.deceased, c.sigma); outlier {
+			findings = append(findings, c.finding(s, j, d, RuleOutlier, "NewDeceased", s.NewDeceased, int(math.Round(mean)),
+				"%d new deaths, against an average of %.0f over the %d days before", s.NewDeceased, mean, len(h.deceased)))
+		}
+		h.push(s, c.window)
+	}
+
+	for _, last := range c.expire(d, current) {
+		findings = append(findings, c.finding(nil, last.Jurisdiction, d, RuleMissingDay, "", 0, 0,
+			"no sample, the last one was on %s", last.Date.Format("2006-01-02")))
+	}
+	for id, s := range current {
+		c.lastSeen[id] = s
+	}
+	return
+}
+
+func (c *sampleChecker) expire(d time.Time, current map[int]*Sample) (missing []*Sample) {
+	missing = make([]*Sample, 0)
+	for id, last := range c.lastSeen {
+		if _, ok := current[id]; ok {
+			continue
+		}
+		if d.Sub(last.Date) > time.Duration(c.missingDays)*24*time.Hour {
+			delete(c.lastSeen, id)
+			continue
+		}
+		missing = append(missing, last)
+	}
+	return
+}
+
+func forgetFindings(mgr *grumble.EntityManager, d time.Time) (err error) {
+	q := mgr.MakeQuery(Finding{})
+	q.AddFilter("Date", d)
+	results, err := q.Execute()
+	if err != nil {
+		return
+	}
+	for _, row := range results {
+		if err = mgr.Delete(row[0]); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// CheckSamples replaces the findings for the dates from up to but not including
+// to. The dates in the outlier window before from are read but not checked.
+func CheckSamples(mgr *grumble.EntityManager, from time.Time, to time.Time, progress ImportProgress) (findings []*Finding, err error) {
+	c := makeSampleChecker(mgr)
+	from, to = utcDate(from), utcDate(to)
+	// Dates after the newest sample are not imported yet
+	_, newest, err := OldestAndNewestSample(mgr)
+	if err != nil {
+		return
+	}
+	c.until = utcDate(newest)
+	for d := from.AddDate(0, 0, -c.window); d.Before(from); d = d.AddDate(0, 0, 1) {
+		if _, err = c.check(d); err != nil {
+			return
+		}
+	}
+	findings = make([]*Finding, 0)
+	total := int(to.Sub(from).Hours() / 24)
+	for d, ix := from, 1; d.Before(to); d, ix = d.AddDate(0, 0, 1), ix+1 {
+		var found []*Finding
+		if found, err = c.check(d); err != nil {
+			return
+		}
+		now := time.Now()
+		err = mgr.TX(func(db *sql.DB) (err error) {
+			if err = forgetFindings(mgr, d); err != nil {
+				return
+			}
+			for _, f := range found {
+				var e grumble.Persistable
+				if e, err = mgr.New(Finding{}, grumble.ZeroKey); err != nil {
+					return
+				}
+				finding := e.(*Finding)
+				finding.Jurisdiction = f.Jurisdiction
+				finding.Sample = f.Sample
+				finding.Date = f.Date
+				finding.Rule = f.Rule
+				finding.Field = f.Field
+				finding.Value = f.Value
+				finding.Expected = f.Expected
+				finding.Message = f.Message
+				finding.Timestamp = now
+				if err = mgr.Put(finding); err != nil {
+					return
+				}
+			}
+			return
+		})
+		if err != nil {
+			return
+		}
+		findings = append(findings, found...)
+		if progress != nil {
+			progress(d, ix, total, len(found), 0)
+		}
+	}
+	return
+}
+
+func (f *Finding) ManyQuery(query *grumble.Query, values url.Values) (ret *grumble.Query) {
+	ret = query
+	if rule := values.Get("rule"); rule != "" {
+		ret.AddFilter("Rule", rule)
+	}
+	if dstr := values.Get("date"); dstr != "" {
+		if d, err := time.ParseInLocation("2006-01-02", dstr, time.UTC); err == nil {
+			ret.AddFilter("Date", d)
+		}
+	}
+	if j := GetJurisdiction(values.Get("jurisdiction")); j != nil {
+		ret.AddCondition(&grumble.References{
+			Column:     "Jurisdiction",
+			References: j.AsKey(),
+		})
+	}
+	ret.AddSort(grumble.Sort{Column: "Date", Direction: "DESC"})
+	ret.AddSort(grumble.Sort{Column: "Rule", Direction: "ASC"})
+	ret.AddReferenceJoins()
+	return
+}
+
+func (f *Finding) MakeListContext(req *handler.EntityRequest, data map[string]interface{}) (err error) {
+	data["Rule"] = req.Values.Get("rule")
+	data["Date"] = req.Values.Get("date")
+	data["Jurisdiction"] = req.Values.Get("jurisdiction")
+	data["rules"] = FindingRules
+	return
+}
+
+func CheckRequest(res http.ResponseWriter, req *http.Request) {
+	mgr, err := grumble.MakeEntityManager()
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, newest, err := OldestAndNewestSample(mgr)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	from := utcDate(newest)
+	if d, err := dateParameter(req, "from"); err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	} else if d != nil {
+		from = *d
+	}
+	to := from.AddDate(0, 0, 1)
+	if d, err := dateParameter(req, "to"); err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	} else if d != nil {
+		to = *d
+	}
+	findings, err := CheckSamples(mgr, from, to, nil)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Checked samples from %s up to %s: %d findings", from.Format("2006-01-02"), to.Format("2006-01-02"), len(findings))
+	if wantsJSON(req) {
+		counts := make(map[string]int)
+		for _, f := range findings {
+			counts[f.Rule]++
+		}
+		res.Header().Set("Content-Type", "application/json")
+		if err = json.NewEncoder(res).Encode(map[string]interface{}{
+			"from":     from.Format("2006-01-02"),
+			"to":       to.Format("2006-01-02"),
+			"findings": len(findings),
+			"rules":    counts,
+		}); err != nil {
+			log.Printf("Error encoding check results: %v", err)
+		}
+		return
+	}
+	redirect := "/finding"
+	if to.Sub(from) <= 24*time.Hour {
+		redirect = fmt.Sprintf("/finding?date=%s", from.Format("2006-01-02"))
+	}
+	http.Redirect(res, req, redirect, http.StatusSeeOther)
+}
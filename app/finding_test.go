@@ -0,0 +1,57 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2020 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSampleCheckerMissingDays(t *testing.T) {
+	nl := testJurisdiction(1, "Netherlands")
+	be := testJurisdiction(2, "Belgium")
+	first := time.Date(2020, 4, 1, 0, 0, 0, 0, time.UTC)
+	day := func(n int) time.Time {
+		return first.AddDate(0, 0, n)
+	}
+	c := makeSampleChecker(nil)
+	c.missingDays = 2
+	c.until = day(10)
+
+	c.checkSamples(day(0), []*Sample{{Jurisdiction: nl, Date: day(0)}, {Jurisdiction: be, Date: day(0)}})
+	findings := c.checkSamples(day(1), []*Sample{{Jurisdiction: nl, Date: day(1)}})
+	if len(findings) != 1 || findings[0].Rule != RuleMissingDay || findings[0].Jurisdiction != be {
+		t.Fatalf("day without a sample for Belgium: %v", findings)
+	}
+	findings = c.checkSamples(day(2), nil)
+	if len(findings) != 1 || findings[0].Jurisdiction != nil {
+		t.Fatalf("day without any samples: %v", findings)
+	}
+	// Belgium has had no sample for more than 2 days
+	if findings = c.checkSamples(day(3), []*Sample{{Jurisdiction: nl, Date: day(3)}}); len(findings) != 0 {
+		t.Errorf("expired jurisdiction still flagged: %v", findings)
+	}
+	if _, ok := c.lastSeen[be.Id()]; ok || len(c.lastSeen) != 1 {
+		t.Errorf("expected only Belgium to be dropped: %v", c.lastSeen)
+	}
+	if findings = c.checkSamples(day(11), nil); len(findings) != 0 {
+		t.Errorf("date after the newest sample flagged: %v", findings)
+	}
+}
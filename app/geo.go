@@ -30,6 +30,7 @@ type Region struct {
 	Name         string
 	Alpha2       string		`json:"alpha-2"`
 	Alpha3       string     `json:"alpha-3"`
+	FIPS         string     `json:"fips"`
 	Alias        []string
 	Regions      []Region
 	Population   int64
@@ -37,7 +38,23 @@ type Region struct {
 	GDPPerCapPPP float64
 }
 
-func (region *Region) Persist(mgr *grumble.EntityManager, parent *Jurisdiction) (j *Jurisdiction, err error) {
+func (region *Region) Persist(tx *RegistryTX, parent *Jurisdiction) (j *Jurisdiction, err error) {
+	if j, err = region.makeJurisdiction(tx.Manager, parent); err != nil {
+		return
+	}
+	if err = tx.Put(j); err != nil {
+		return
+	}
+	for _, sub := range region.Regions {
+		_, err = sub.Persist(tx, j)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (region *Region) makeJurisdiction(mgr *grumble.EntityManager, parent *Jurisdiction) (j *Jurisdiction, err error) {
 	log.Printf("Creating %q", region.Name)
 	pkey := grumble.ZeroKey
 	if parent != nil {
@@ -51,6 +68,7 @@ func (region *Region) Persist(mgr *grumble.EntityManager, parent *Jurisdiction)
 	j.Name = region.Name
 	j.Alpha2 = region.Alpha2
 	j.Alpha3 = region.Alpha3
+	j.FIPS = region.FIPS
 	j.Population = region.Population
 	j.MedianAge = region.MedianAge
 	j.GDPPerCapPPP = region.GDPPerCapPPP
@@ -58,16 +76,6 @@ func (region *Region) Persist(mgr *grumble.EntityManager, parent *Jurisdiction)
 		j.Aliases = make([]string, len(region.Alias))
 		copy(j.Aliases, region.Alias)
 	}
-	if err = mgr.Put(j); err != nil {
-		return
-	}
-	j.Cache()
-	for _, sub := range region.Regions {
-		_, err = sub.Persist(mgr, j)
-		if err != nil {
-			return
-		}
-	}
 	return
 }
 
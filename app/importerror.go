@@ -0,0 +1,112 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2020 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package app
+
+import (
+	"fmt"
+	"github.com/JanDeVisser/grumble"
+	"github.com/JanDeVisser/grumble/handler"
+	"net/url"
+	"strings"
+)
+
+const (
+	ErrorUnknownCountry = "unknown-country"
+	ErrorNoCountry      = "no-country"
+	ErrorParse          = "parse-error"
+	ErrorMissingColumn  = "missing-column"
+	ErrorStorage        = "storage-error"
+)
+
+var ErrorCategories = []string{
+	ErrorUnknownCountry,
+	ErrorNoCountry,
+	ErrorParse,
+	ErrorMissingColumn,
+	ErrorStorage,
+}
+
+// ImportError is a row of a report that could not be imported.
+type ImportError struct {
+	grumble.Key
+	File     string
+	Line     int
+	Record   string
+	Category string
+	Reason   string
+}
+
+type RowError struct {
+	Category string
+	Reason   string
+	Line     int
+	Raw      []string
+}
+
+func (e *RowError) Error() string {
+	return e.Reason
+}
+
+func rowError(category string, format string, args ...interface{}) *RowError {
+	return &RowError{Category: category, Reason: fmt.Sprintf(format, args...)}
+}
+
+func (e *RowError) persist(mgr *grumble.EntityManager, parent *ImportRecord) (err error) {
+	ie, err := mgr.New(ImportError{}, parent.AsKey())
+	if err != nil {
+		return
+	}
+	impErr := ie.(*ImportError)
+	impErr.File = parent.JHUFile
+	impErr.Line = e.Line
+	impErr.Record = strings.Join(e.Raw, ",")
+	impErr.Category = e.Category
+	impErr.Reason = e.Reason
+	return mgr.Put(impErr)
+}
+
+// importTolerance is the fraction of the rows of a report that may fail before
+// the report is rejected.
+func importTolerance() float64 {
+	if tolIface, ok := handler.GetAppConfig()["importtolerance"]; ok {
+		return tolIface.(float64)
+	}
+	return 0.0
+}
+
+func (impErr *ImportError) ManyQuery(query *grumble.Query, values url.Values) (ret *grumble.Query) {
+	ret = query
+	if category := values.Get("category"); category != "" {
+		ret.AddFilter("Category", category)
+	}
+	if file := values.Get("file"); file != "" {
+		ret.AddFilter("File", file)
+	}
+	ret.AddSort(grumble.Sort{Column: "File", Direction: "DESC"})
+	ret.AddSort(grumble.Sort{Column: "Line", Direction: "ASC"})
+	return
+}
+
+func (impErr *ImportError) MakeListContext(req *handler.EntityRequest, data map[string]interface{}) (err error) {
+	data["Category"] = req.Values.Get("category")
+	data["File"] = req.Values.Get("file")
+	data["categories"] = ErrorCategories
+	return
+}
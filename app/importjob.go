@@ -0,0 +1,342 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2020 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/JanDeVisser/grumble"
+	"github.com/JanDeVisser/grumble/handler"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	JobQueued  = "Queued"
+	JobRunning = "Running"
+	JobDone    = "Done"
+	JobFailed  = "Failed"
+)
+
+// ImportJob is an import submitted over HTTP, run by a background worker.
+type ImportJob struct {
+	grumble.Key
+	Source      string
+	Dir         string
+	Revise      bool
+	Force       bool
+	From        time.Time
+	To          time.Time
+	Status      string
+	Submitted   time.Time
+	Started     time.Time
+	Finished    time.Time
+	CurrentDate time.Time `grumble:"verbose_name=Current Date"`
+	Days        int
+	DaysDone    int `grumble:"verbose_name=Days Done"`
+	Rows        int
+	Errors      int
+	Message     string
+}
+
+var importJobs = make(chan *ImportJob, 32)
+
+var ErrImportQueueFull = errors.New("too many imports are queued, try again later")
+
+func submitJobError(res http.ResponseWriter, err error) {
+	if errors.Is(err, ErrImportQueueFull) {
+		http.Error(res, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(res, err.Error(), http.StatusInternalServerError)
+}
+
+func StartImportWorker(mgr *grumble.EntityManager) (err error) {
+	q := mgr.MakeQuery(ImportJob{})
+	results, err := q.Execute()
+	if err != nil {
+		return
+	}
+	for _, row := range results {
+		job := row[0].(*ImportJob)
+		if job.Status == JobQueued || job.Status == JobRunning {
+			job.Status = JobFailed
+			job.Message = "Interrupted by shutdown"
+			if err = mgr.Put(job); err != nil {
+				return
+			}
+		}
+	}
+	go importWorker()
+	return
+}
+
+func importWorker() {
+	for job := range importJobs {
+		job.Run()
+	}
+}
+
+// SubmitImportJob queues an import job. If force is set, revised dates are
+// re-imported even if their report didn't change.
+func SubmitImportJob(mgr *grumble.EntityManager, source string, dir string, from *time.Time, to *time.Time, revise bool, force bool) (job *ImportJob, err error) {
+	e, err := mgr.New(ImportJob{}, grumble.ZeroKey)
+	if err != nil {
+		return
+	}
+	job = e.(*ImportJob)
+	job.Source = source
+	job.Dir = dir
+	job.Revise = revise
+	job.Force = force
+	if from != nil {
+		job.From = *from
+	}
+	if to != nil {
+		job.To = *to
+	}
+	job.Status = JobQueued
+	job.Submitted = time.Now()
+	if err = mgr.Put(job); err != nil {
+		return
+	}
+	select {
+	case importJobs <- job:
+	default:
+		job.Status = JobFailed
+		job.Message = ErrImportQueueFull.Error()
+		job.update()
+		return nil, ErrImportQueueFull
+	}
+	return
+}
+
+func (job *ImportJob) source() (source SampleSource, err error) {
+	if job.Dir != "" {
+		return MakeDirectorySource(job.Dir), nil
+	}
+	return GetSampleSource(job.Source)
+}
+
+func (job *ImportJob) update() {
+	if err := job.Manager().Put(job); err != nil {
+		log.Printf("Error updating import job %d: %v", job.Id(), err)
+	}
+}
+
+func (job *ImportJob) Run() {
+	job.Status = JobRunning
+	job.Started = time.Now()
+	job.update()
+
+	err := job.run()
+
+	job.Finished = time.Now()
+	if err != nil {
+		log.Printf("Import job %d failed: %v", job.Id(), err)
+		job.Status = JobFailed
+		job.Message = err.Error()
+	} else {
+		job.Status = JobDone
+	}
+	job.update()
+}
+
+// A panic fails the job instead of taking down the worker.
+func (job *ImportJob) run() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Import job %d panicked: %v\n%s", job.Id(), r, debug.Stack())
+			err = fmt.Errorf("import panicked: %v", r)
+		}
+	}()
+	source, err := job.source()
+	if err != nil {
+		return
+	}
+	var from, to *time.Time
+	if !job.From.IsZero() {
+		from = &job.From
+	}
+	if !job.To.IsZero() {
+		to = &job.To
+	}
+	importer := MakeImporter(job.Manager(), source)
+	importer.Revise = job.Revise
+	importer.Force = job.Force
+	importer.Progress = job.progress
+	return importer.Import(from, to)
+}
+
+func (job *ImportJob) progress(d time.Time, done int, total int, rows int, errors int) {
+	job.CurrentDate = d
+	job.DaysDone = done
+	job.Days = total
+	job.Rows += rows
+	job.Errors += errors
+	job.update()
+}
+
+func (job *ImportJob) Percentage() int {
+	if job.Days == 0 {
+		return 0
+	}
+	return 100 * job.DaysDone / job.Days
+}
+
+func (job *ImportJob) Active() bool {
+	return job.Status == JobQueued || job.Status == JobRunning
+}
+
+/* ================================================================================================================ */
+
+type importJobStatus struct {
+	Id          int        `json:"id"`
+	Status      string     `json:"status"`
+	Source      string     `json:"source"`
+	Dir         string     `json:"dir,omitempty"`
+	Revise      bool       `json:"revise"`
+	Force       bool       `json:"force"`
+	From        *time.Time `json:"from,omitempty"`
+	To          *time.Time `json:"to,omitempty"`
+	Submitted   time.Time  `json:"submitted"`
+	Started     *time.Time `json:"started,omitempty"`
+	Finished    *time.Time `json:"finished,omitempty"`
+	CurrentDate *time.Time `json:"current_date,omitempty"`
+	Days        int        `json:"days"`
+	DaysDone    int        `json:"days_done"`
+	Rows        int        `json:"rows"`
+	Errors      int        `json:"errors"`
+	Message     string     `json:"message,omitempty"`
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func (job *ImportJob) status() importJobStatus {
+	return importJobStatus{
+		Id:          job.Id(),
+		Status:      job.Status,
+		Source:      job.Source,
+		Dir:         job.Dir,
+		Revise:      job.Revise,
+		Force:       job.Force,
+		From:        timePtr(job.From),
+		To:          timePtr(job.To),
+		Submitted:   job.Submitted,
+		Started:     timePtr(job.Started),
+		Finished:    timePtr(job.Finished),
+		CurrentDate: timePtr(job.CurrentDate),
+		Days:        job.Days,
+		DaysDone:    job.DaysDone,
+		Rows:        job.Rows,
+		Errors:      job.Errors,
+		Message:     job.Message,
+	}
+}
+
+func recentImportJobs(mgr *grumble.EntityManager, id int) (jobs []*ImportJob, err error) {
+	jobs = make([]*ImportJob, 0)
+	if id != 0 {
+		var e grumble.Persistable
+		if e, err = mgr.Get(ImportJob{}, id); err == nil && e != nil {
+			jobs = append(jobs, e.(*ImportJob))
+		}
+		return
+	}
+	q := mgr.MakeQuery(ImportJob{})
+	q.AddSort(grumble.Sort{Column: "Submitted", Direction: "DESC"})
+	q.Limit = 20
+	results, err := q.Execute()
+	if err != nil {
+		return
+	}
+	for _, row := range results {
+		jobs = append(jobs, row[0].(*ImportJob))
+	}
+	return
+}
+
+type ImportStatusContext struct {
+	Jobs []*ImportJob
+}
+
+func (isc *ImportStatusContext) MakeContext(req *handler.PlainRequest) (err error) {
+	active := false
+	for _, job := range isc.Jobs {
+		active = active || job.Active()
+	}
+	data := make(map[string]interface{})
+	data["jobs"] = isc.Jobs
+	data["active"] = active
+	data["sources"] = SampleSources()
+	req.Data = data
+	req.Template = "html/import/status.html"
+	return
+}
+
+func wantsJSON(req *http.Request) bool {
+	return req.FormValue("format") == "json" || strings.Contains(req.Header.Get("Accept"), "application/json")
+}
+
+func ImportStatusRequest(res http.ResponseWriter, req *http.Request) {
+	mgr, err := grumble.MakeEntityManager()
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	id := 0
+	if jobId := req.FormValue("job"); jobId != "" {
+		if id, err = strconv.Atoi(jobId); err != nil {
+			http.Error(res, fmt.Sprintf("Invalid job id %q", jobId), http.StatusBadRequest)
+			return
+		}
+	}
+	jobs, err := recentImportJobs(mgr, id)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if id != 0 && len(jobs) == 0 {
+		http.Error(res, fmt.Sprintf("Import job %d not found", id), http.StatusNotFound)
+		return
+	}
+	if wantsJSON(req) {
+		statuses := make([]importJobStatus, 0)
+		for _, job := range jobs {
+			statuses = append(statuses, job.status())
+		}
+		res.Header().Set("Content-Type", "application/json")
+		if err = json.NewEncoder(res).Encode(statuses); err != nil {
+			log.Printf("Error encoding import status: %v", err)
+		}
+		return
+	}
+	handler.ServePlainPage(res, req, &ImportStatusContext{Jobs: jobs})
+}
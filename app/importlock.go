@@ -0,0 +1,183 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2020 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package app
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/JanDeVisser/grumble"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ImportLock keeps concurrent imports from importing the same date. Locks
+// older than importlocktimeout are taken over.
+type ImportLock struct {
+	grumble.Key
+	JHUFile  string
+	Owner    string
+	Acquired time.Time
+}
+
+// importLocks serializes lock changes within this process, and the advisory
+// lock importLockKey across processes.
+var importLocks sync.Mutex
+
+const importLockKey = 0x636f766964
+
+// acquireImportLockMutex uses a connection of its own, since the advisory lock
+// belongs to the session.
+func acquireImportLockMutex(db *sql.DB) (conn *sql.Conn, err error) {
+	ctx := context.Background()
+	if conn, err = db.Conn(ctx); err != nil {
+		return
+	}
+	if _, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", importLockKey); err != nil {
+		_ = conn.Close()
+		conn = nil
+	}
+	return
+}
+
+func releaseImportLockMutex(conn *sql.Conn) {
+	if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", importLockKey); err != nil {
+		log.Printf("Error releasing import lock mutex: %v", err)
+		// Discarding the connection ends the session and with it the lock
+		_ = conn.Raw(func(interface{}) error {
+			return driver.ErrBadConn
+		})
+	}
+	_ = conn.Close()
+}
+
+var lockOwnerSeq int64
+
+func makeLockOwner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	return fmt.Sprintf("%s/%d/%d", host, os.Getpid(), atomic.AddInt64(&lockOwnerSeq, 1))
+}
+
+func (importer *Importer) lock(todo []*ImportRecord) (locked []*ImportRecord, err error) {
+	importLocks.Lock()
+	defer importLocks.Unlock()
+	mgr := importer.Manager
+	timeout := configSeconds("importlocktimeout", 6*60*60)
+	var conn *sql.Conn
+	defer func() {
+		if conn != nil {
+			releaseImportLockMutex(conn)
+		}
+	}()
+	err = mgr.TX(func(db *sql.DB) (err error) {
+		if conn, err = acquireImportLockMutex(db); err != nil {
+			return
+		}
+		locked = make([]*ImportRecord, 0, len(todo))
+		for _, imp := range todo {
+			var e grumble.Persistable
+			if e, err = mgr.By(ImportLock{}, "JHUFile", imp.JHUFile); err != nil {
+				return
+			}
+			var l *ImportLock
+			if e != nil {
+				l = e.(*ImportLock)
+				if age := time.Since(l.Acquired); l.Owner != importer.owner && age < timeout {
+					log.Printf("Skipping %q: %s is importing it since %v", imp.JHUFile, l.Owner, l.Acquired)
+					importer.Stats.Locked++
+					continue
+				}
+				log.Printf("Taking over lock on %q held by %s since %v", imp.JHUFile, l.Owner, l.Acquired)
+			} else {
+				if e, err = mgr.New(ImportLock{}, grumble.ZeroKey); err != nil {
+					return
+				}
+				l = e.(*ImportLock)
+				l.JHUFile = imp.JHUFile
+			}
+			l.Owner = importer.owner
+			l.Acquired = time.Now()
+			if err = mgr.Put(l); err != nil {
+				return
+			}
+			locked = append(locked, imp)
+		}
+		return
+	})
+	return
+}
+
+func (importer *Importer) unlock(locked []*ImportRecord) {
+	importLocks.Lock()
+	defer importLocks.Unlock()
+	mgr := importer.Manager
+	var conn *sql.Conn
+	defer func() {
+		if conn != nil {
+			releaseImportLockMutex(conn)
+		}
+	}()
+	err := mgr.TX(func(db *sql.DB) (err error) {
+		if conn, err = acquireImportLockMutex(db); err != nil {
+			return
+		}
+		for _, imp := range locked {
+			var e grumble.Persistable
+			if e, err = mgr.By(ImportLock{}, "JHUFile", imp.JHUFile); err != nil {
+				return
+			}
+			if e == nil || e.(*ImportLock).Owner != importer.owner {
+				continue
+			}
+			if err = mgr.Delete(e); err != nil {
+				return
+			}
+		}
+		return
+	})
+	if err != nil {
+		log.Printf("Error releasing import locks: %v", err)
+	}
+}
+
+// stillPending drops the dates another import finished between reading the
+// import records and taking the locks.
+func stillPending(locked []*ImportRecord, current map[string]*ImportRecord, revising func(d time.Time) bool) (pending []*ImportRecord) {
+	pending = make([]*ImportRecord, 0, len(locked))
+	for _, imp := range locked {
+		if cur, ok := current[imp.JHUFile]; ok {
+			d, err := cur.Date()
+			if cur.State() == ImportImported && err == nil && !revising(d) {
+				log.Printf("Skipping %q: it was imported by another import", imp.JHUFile)
+				continue
+			}
+			imp = cur
+		}
+		pending = append(pending, imp)
+	}
+	return
+}
@@ -0,0 +1,64 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2020 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStillPending(t *testing.T) {
+	locked := []*ImportRecord{
+		{JHUFile: "04-01-2020", Status: ImportPending},
+		{JHUFile: "04-02-2020", Status: ImportPending},
+		{JHUFile: "04-03-2020", Status: ImportFailed},
+		{JHUFile: "04-04-2020", Status: ImportImported},
+	}
+	current := map[string]*ImportRecord{
+		// Imported by another import while this one waited for the lock
+		"04-01-2020": {JHUFile: "04-01-2020", Status: ImportImported, Hash: "abc"},
+		"04-03-2020": {JHUFile: "04-03-2020", Status: ImportFailed, Attempts: 2},
+		"04-04-2020": {JHUFile: "04-04-2020", Status: ImportImported, Hash: "def"},
+	}
+
+	never := func(time.Time) bool { return false }
+	always := func(time.Time) bool { return true }
+	pending := stillPending(locked, current, never)
+	if len(pending) != 2 || pending[0].JHUFile != "04-02-2020" || pending[1].JHUFile != "04-03-2020" {
+		t.Fatalf("pending %v, expected 04-02-2020 and 04-03-2020", pending)
+	}
+	if pending[1].Attempts != 2 {
+		t.Errorf("pending record for 04-03-2020 was not reloaded")
+	}
+
+	pending = stillPending(locked, current, always)
+	if len(pending) != len(locked) {
+		t.Fatalf("revising keeps %d of %d dates", len(pending), len(locked))
+	}
+	if pending[0].Hash != "abc" {
+		t.Errorf("revised record for 04-01-2020 was not reloaded")
+	}
+}
+
+func TestLockOwnersAreUnique(t *testing.T) {
+	if a, b := makeLockOwner(), makeLockOwner(); a == b {
+		t.Errorf("two importers got lock owner %q", a)
+	}
+}
@@ -0,0 +1,253 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2020 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package app
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/JanDeVisser/grumble"
+	"github.com/JanDeVisser/grumble/handler"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	ImportPending  = "pending"
+	ImportImported = "imported"
+	ImportMissing  = "missing-upstream"
+	ImportFailed   = "failed"
+)
+
+const importRetryDelay = time.Hour
+const importRetryMaxDelay = 7 * 24 * time.Hour
+
+type ImportRecord struct {
+	grumble.Key
+	Timestamp   time.Time
+	JHUFile     string
+	Status      string
+	Count       int
+	ErrorCount  int
+	Rejected    bool
+	Hash        string
+	Attempts    int
+	NextAttempt time.Time `grumble:"verbose_name=Next Attempt"`
+	Message     string
+}
+
+func reportName(d time.Time) string {
+	return d.Format("01-02-2006")
+}
+
+func utcDate(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func (imp *ImportRecord) State() string {
+	switch {
+	case imp.Status != "":
+		return imp.Status
+	// Records written before the status was tracked
+	case imp.Rejected:
+		return ImportFailed
+	default:
+		return ImportImported
+	}
+}
+
+func (imp *ImportRecord) Date() (time.Time, error) {
+	return time.ParseInLocation("01-02-2006", imp.JHUFile, time.UTC)
+}
+
+func retryDelay(attempts int) (delay time.Duration) {
+	delay = importRetryDelay
+	for i := 1; i < attempts && delay < importRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > importRetryMaxDelay {
+		delay = importRetryMaxDelay
+	}
+	return
+}
+
+func (imp *ImportRecord) retryLater(status string, message string) {
+	imp.Status = status
+	imp.Message = message
+	imp.NextAttempt = time.Now().Add(retryDelay(imp.Attempts))
+	log.Printf("Import of %q %s, retrying after %v", imp.JHUFile, status, imp.NextAttempt.Format(time.RFC3339))
+}
+
+func (imp *ImportRecord) imported() {
+	imp.Status = ImportImported
+	imp.Message = ""
+	imp.NextAttempt = time.Time{}
+}
+
+func importRecords(mgr *grumble.EntityManager) (records map[string]*ImportRecord, err error) {
+	records = make(map[string]*ImportRecord)
+	q := mgr.MakeQuery(ImportRecord{})
+	results, err := q.Execute()
+	if err != nil {
+		return
+	}
+	for _, row := range results {
+		imp := row[0].(*ImportRecord)
+		records[imp.JHUFile] = imp
+	}
+	return
+}
+
+func newImportRecord(mgr *grumble.EntityManager, d time.Time) (imp *ImportRecord, err error) {
+	e, err := mgr.New(ImportRecord{}, grumble.ZeroKey)
+	if err != nil {
+		return
+	}
+	imp = e.(*ImportRecord)
+	imp.JHUFile = reportName(d)
+	imp.Status = ImportPending
+	return
+}
+
+func finishImportRecord(mgr *grumble.EntityManager, imp *ImportRecord, rowErrors []*RowError) (err error) {
+	err = mgr.TX(func(db *sql.DB) (err error) {
+		if err = forgetImportErrors(mgr, imp.JHUFile); err != nil {
+			return
+		}
+		imp.ErrorCount = len(rowErrors)
+		if err = mgr.Put(imp); err != nil {
+			return
+		}
+		for _, rowErr := range rowErrors {
+			if err = rowErr.persist(mgr, imp); err != nil {
+				return
+			}
+		}
+		return
+	})
+	if err != nil {
+		log.Printf("Error writing import record for %q: %v", imp.JHUFile, err)
+	}
+	return
+}
+
+/* ================================================================================================================ */
+
+type HTTPError struct {
+	URL        string
+	StatusCode int
+	Body       string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("%s: HTTP %d %s", e.URL, e.StatusCode, e.Body)
+}
+
+func isMissingReport(err error) bool {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode == http.StatusNotFound
+	}
+	return errors.Is(err, os.ErrNotExist)
+}
+
+/* ================================================================================================================ */
+
+type ImportGap struct {
+	Date        time.Time  `json:"date"`
+	Status      string     `json:"status"`
+	Attempts    int        `json:"attempts"`
+	NextAttempt *time.Time `json:"next_attempt,omitempty"`
+	Message     string     `json:"message,omitempty"`
+}
+
+func ImportGaps(mgr *grumble.EntityManager, from time.Time, to time.Time) (gaps []*ImportGap, err error) {
+	records, err := importRecords(mgr)
+	if err != nil {
+		return
+	}
+	gaps = make([]*ImportGap, 0)
+	for d := utcDate(from); d.Before(to); d = d.AddDate(0, 0, 1) {
+		imp, ok := records[reportName(d)]
+		switch {
+		case !ok:
+			gaps = append(gaps, &ImportGap{Date: d, Status: ImportPending})
+		case imp.State() != ImportImported:
+			gaps = append(gaps, &ImportGap{
+				Date:        d,
+				Status:      imp.State(),
+				Attempts:    imp.Attempts,
+				NextAttempt: timePtr(imp.NextAttempt),
+				Message:     imp.Message,
+			})
+		}
+	}
+	return
+}
+
+type ImportGapsContext struct {
+	Gaps []*ImportGap
+}
+
+func (igc *ImportGapsContext) MakeContext(req *handler.PlainRequest) (err error) {
+	data := make(map[string]interface{})
+	data["gaps"] = igc.Gaps
+	req.Data = data
+	req.Template = "html/import/gaps.html"
+	return
+}
+
+func ImportGapsRequest(res http.ResponseWriter, req *http.Request) {
+	mgr, err := grumble.MakeEntityManager()
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	from := JHUFirstReport
+	if d, err := dateParameter(req, "from"); err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	} else if d != nil {
+		from = *d
+	}
+	to := utcDate(time.Now()).AddDate(0, 0, 1)
+	if d, err := dateParameter(req, "to"); err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	} else if d != nil {
+		to = *d
+	}
+	gaps, err := ImportGaps(mgr, from, to)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if wantsJSON(req) {
+		res.Header().Set("Content-Type", "application/json")
+		if err = json.NewEncoder(res).Encode(gaps); err != nil {
+			log.Printf("Error encoding import gaps: %v", err)
+		}
+		return
+	}
+	handler.ServePlainPage(res, req, &ImportGapsContext{Gaps: gaps})
+}
@@ -21,90 +21,313 @@ package app
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/csv"
 	"errors"
 	"fmt"
 	"github.com/JanDeVisser/grumble"
 	"github.com/JanDeVisser/grumble/handler"
-	"io/ioutil"
+	"io"
 	"log"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"time"
 )
 
-type ImportRecord struct {
-	grumble.Key
-	Timestamp  time.Time
-	JHUFile    string
-	Count      int
-	ErrorCount int
-	Errors     string
+/* ================================================================================================================ */
+
+const JHUBaseURL = "https://raw.github.com/CSSEGISandData/COVID-19/master/csse_covid_19_data/csse_covid_19_daily_reports"
+
+var JHUFirstReport = time.Date(2020, 1, 22, 0, 0, 0, 0, time.UTC)
+
+type JHUSource struct {
+	BaseURL    string
+	Downloader *Downloader
+	Cache      *FetchCache
 }
 
-func download(report string) (data []byte, err error) {
-	log.Printf("Downloading %s", report)
-	resp, err := http.Get(report)
-	if err != nil {
-		return
+func MakeJHUSource() SampleSource {
+	ret := &JHUSource{BaseURL: JHUBaseURL, Downloader: MakeDownloader()}
+	if cacheIface, ok := handler.GetAppConfig()["usecache"]; ok && cacheIface.(bool) {
+		ret.Cache = MakeFetchCache()
+	}
+	return ret
+}
+
+func init() {
+	RegisterSampleSource("jhu", MakeJHUSource)
+}
+
+func (jhu *JHUSource) Name() string {
+	return "jhu"
+}
+
+func (jhu *JHUSource) Dates(from time.Time, to time.Time) (dates []time.Time, err error) {
+	dates = make([]time.Time, 0)
+	d := from
+	if d.Before(JHUFirstReport) {
+		d = JHUFirstReport
+	}
+	for ; to.After(d); d = d.AddDate(0, 0, 1) {
+		dates = append(dates, d)
+	}
+	return
+}
+
+func (jhu *JHUSource) cacheName(d time.Time) string {
+	return reportName(d) + ".csv"
+}
+
+func (jhu *JHUSource) Fetch(ctx context.Context, d time.Time) (data []byte, err error) {
+	url := fmt.Sprintf("%s/%s.csv", jhu.BaseURL, reportName(d))
+	if jhu.Cache != nil {
+		return jhu.Cache.Get(ctx, jhu.Downloader, jhu.cacheName(d), url)
 	}
-	defer func() {
-		e := resp.Body.Close()
-		if err == nil {
-			err = e
+	return jhu.Downloader.Get(ctx, url)
+}
+
+func (jhu *JHUSource) Invalidate(d time.Time) {
+	if jhu.Cache != nil {
+		if err := jhu.Cache.Expire(jhu.cacheName(d)); err != nil {
+			log.Printf("Error expiring cached report %q: %v", jhu.cacheName(d), err)
+		}
+	}
+}
+
+func (jhu *JHUSource) Parse(d time.Time, data []byte) (records []*SampleRecord, err error) {
+	records, err = parseJHUReport(reportName(d)+".csv", data)
+	if err != nil && jhu.Cache != nil {
+		_ = jhu.Cache.Remove(jhu.cacheName(d))
+	}
+	return
+}
+
+const (
+	jhuFIPS              = "FIPS"
+	jhuAdmin2            = "Admin2"
+	jhuProvState         = "ProvState"
+	jhuCountryName       = "CountryName"
+	jhuConfirmed         = "Confirmed"
+	jhuDeaths            = "Deaths"
+	jhuRecovered         = "Recovered"
+	jhuActive            = "Active"
+	jhuIncidentRate      = "IncidentRate"
+	jhuCaseFatalityRatio = "CaseFatalityRatio"
+	jhuTests             = "Tests"
+	jhuHospitalized      = "Hospitalized"
+)
+
+var jhuMetrics = map[string]string{
+	jhuTests:        "tests",
+	jhuHospitalized: "hospitalized",
+}
+
+// jhuHeaders maps the headers of all versions of the JHU layout to fields.
+var jhuHeaders = map[string]string{
+	"FIPS":                jhuFIPS,
+	"Admin2":              jhuAdmin2,
+	"Province/State":      jhuProvState,
+	"Province_State":      jhuProvState,
+	"Country/Region":      jhuCountryName,
+	"Country_Region":      jhuCountryName,
+	"Confirmed":           jhuConfirmed,
+	"Deaths":              jhuDeaths,
+	"Recovered":           jhuRecovered,
+	"Active":              jhuActive,
+	"Incident_Rate":       jhuIncidentRate,
+	"Incidence_Rate":      jhuIncidentRate,
+	"Case_Fatality_Ratio": jhuCaseFatalityRatio,
+	"Case-Fatality_Ratio": jhuCaseFatalityRatio,
+	"People_Tested":       jhuTests,
+	"Total_Test_Results":  jhuTests,
+	"People_Hospitalized": jhuHospitalized,
+}
+
+var jhuRequiredColumns = []string{jhuCountryName, jhuConfirmed, jhuDeaths}
+
+type MissingColumnError struct {
+	Column string
+	Header []string
+}
+
+func (e *MissingColumnError) Error() string {
+	return fmt.Sprintf("required column %q missing from header %q", e.Column, strings.Join(e.Header, ","))
+}
+
+type jhuColumnMap map[string]int
+
+func makeJHUColumnMap(header []string) (columns jhuColumnMap, err error) {
+	columns = make(jhuColumnMap)
+	for ix, h := range header {
+		h = strings.TrimSpace(strings.TrimPrefix(h, "\ufeff"))
+		if field, ok := jhuHeaders[h]; ok {
+			if _, ok := columns[field]; !ok {
+				columns[field] = ix
+			}
+		}
+	}
+	for _, field := range jhuRequiredColumns {
+		if _, ok := columns[field]; !ok {
+			err = &MissingColumnError{Column: field, Header: header}
+			return
 		}
-	}()
-	if resp.StatusCode == http.StatusOK {
-		data, err = ioutil.ReadAll(resp.Body)
-	} else {
-		data, err = ioutil.ReadAll(resp.Body)
-		err = errors.New(string(data))
 	}
 	return
 }
 
-func parseInt(s string) int {
-	if s == "" {
-		return 0
+func (columns jhuColumnMap) get(row []string, field string) string {
+	if ix, ok := columns[field]; ok && ix < len(row) {
+		return strings.TrimSpace(row[ix])
 	}
-	if len(s) > 2 && s[len(s)-2:] == ".0" {
-		s = s[:len(s)-2]
+	return ""
+}
+
+// jhuRowParser keeps only the first error of a row.
+type jhuRowParser struct {
+	file    string
+	header  []string
+	columns jhuColumnMap
+	row     []string
+	rec     *SampleRecord
+}
+
+func (p *jhuRowParser) fail(field string, value string, err error) {
+	if p.rec.Err != nil {
+		return
 	}
-	i, err := strconv.ParseInt(s, 10, 64)
+	ix := p.columns[field]
+	p.rec.Err = &ParseError{
+		File:   p.file,
+		Line:   p.rec.Line,
+		Column: ix + 1,
+		Header: strings.TrimPrefix(p.header[ix], "\ufeff"),
+		Value:  value,
+		Err:    err,
+	}
+}
+
+func (p *jhuRowParser) count(field string) (i int) {
+	value := p.columns.get(p.row, field)
+	i, err := parseCount(value)
+	if err != nil {
+		p.fail(field, value, err)
+	}
+	return
+}
+
+func (p *jhuRowParser) float(field string) (f float64) {
+	value := p.columns.get(p.row, field)
+	f, err := parseNumber(value)
 	if err != nil {
-		log.Fatal(err)
+		p.fail(field, value, err)
+	}
+	return
+}
+
+func (p *jhuRowParser) metric(field string, metric string) {
+	if p.columns.get(p.row, field) == "" {
+		return
+	}
+	if i := p.count(field); p.rec.Err == nil {
+		if p.rec.Metrics == nil {
+			p.rec.Metrics = make(map[string]int)
+		}
+		p.rec.Metrics[metric] = i
 	}
-	return int(i)
 }
 
-func parseFloat(s string) float64 {
-	if s == "" {
-		return 0.0
+func parseJHUReport(fname string, data []byte) (records []*SampleRecord, err error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, errors.New("empty report")
+	} else if err != nil {
+		return
 	}
-	f, err := strconv.ParseFloat(s, 64)
+	columns, err := makeJHUColumnMap(header)
 	if err != nil {
-		log.Fatal(err)
+		return
+	}
+	records = make([]*SampleRecord, 0)
+	for {
+		var row []string
+		if row, err = r.Read(); err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return
+		}
+		// Quoted fields can span lines
+		line, _ := r.FieldPos(0)
+		rec := &SampleRecord{Line: line, Raw: row}
+		p := &jhuRowParser{file: fname, header: header, columns: columns, row: row, rec: rec}
+		rec.FIPS = columns.get(row, jhuFIPS)
+		rec.Admin2 = columns.get(row, jhuAdmin2)
+		rec.ProvState = columns.get(row, jhuProvState)
+		rec.CountryName = columns.get(row, jhuCountryName)
+		rec.Confirmed = p.count(jhuConfirmed)
+		rec.Deceased = p.count(jhuDeaths)
+		rec.Recovered = p.count(jhuRecovered)
+		rec.Active = p.count(jhuActive)
+		rec.IncidentRate = p.float(jhuIncidentRate)
+		rec.CaseFatalityRatio = p.float(jhuCaseFatalityRatio)
+		for field, metric := range jhuMetrics {
+			p.metric(field, metric)
+		}
+		records = append(records, rec)
 	}
-	return f
 }
 
-var samples map[string]*Sample
+/* ================================================================================================================ */
+
+type ImportStats struct {
+	Dates    int `json:"dates"`
+	Imported int `json:"imported"`
+	Rows     int `json:"rows"`
+	Errors   int `json:"errors"`
+	Locked   int `json:"locked"`
+}
+
+// Importer holds the state of a single import run and is not safe for
+// concurrent use.
+type Importer struct {
+	Manager        *grumble.EntityManager
+	Source         SampleSource
+	Save           bool
+	Revise         bool
+	Force          bool
+	Progress       ImportProgress
+	Stats          ImportStats
+	owner          string
+	samples        map[string]*Sample
+	unknownRegions map[string]*unknownRegionStats
+}
+
+func MakeImporter(mgr *grumble.EntityManager, source SampleSource) *Importer {
+	return &Importer{
+		Manager:        mgr,
+		Source:         source,
+		Save:           true,
+		owner:          makeLockOwner(),
+		samples:        make(map[string]*Sample),
+		unknownRegions: make(map[string]*unknownRegionStats),
+	}
+}
 
-func getSample(mgr *grumble.EntityManager, parent *Sample, d time.Time, j *Jurisdiction, r []string) (s *Sample, err error) {
+func (importer *Importer) getSample(parent *Sample, d time.Time, j *Jurisdiction, rec *SampleRecord) (s *Sample, err error) {
 	var ok bool
 	pk := grumble.ZeroKey
 	if parent == nil {
-		s, ok = samples[j.Name]
+		s, ok = importer.samples[j.Name]
 	} else {
 		pk = parent.AsKey()
 		s, ok = parent.subs[j.Name]
 	}
 	if !ok {
 		var e grumble.Persistable
-		e, err = mgr.New(Sample{}, pk)
+		e, err = importer.Manager.New(Sample{}, pk)
 		if err != nil {
 			return
 		}
@@ -114,116 +337,122 @@ func getSample(mgr *grumble.EntityManager, parent *Sample, d time.Time, j *Juris
 		if parent != nil {
 			parent.subs[j.Name] = s
 		} else {
-			samples[j.Name] = s
-		}
-	}
-	switch len(r) {
-	case 6:
-		s.Confirmed += parseInt(r[3])
-		s.Deceased += parseInt(r[4])
-		s.Recovered += parseInt(r[5])
-	case 8:
-		s.Confirmed += parseInt(r[3])
-		s.Deceased += parseInt(r[4])
-		s.Recovered += parseInt(r[5])
-	default:
-		s.Confirmed += parseInt(r[7])
-		s.Deceased += parseInt(r[8])
-		s.Recovered += parseInt(r[9])
+			importer.samples[j.Name] = s
+		}
 	}
+	s.Confirmed += rec.Confirmed
+	s.Deceased += rec.Deceased
+	s.Recovered += rec.Recovered
+	s.addMetrics(rec)
 	return
 }
 
-var unknownRegionsByCountry = make(map[string][]string)
-
-func unknownRegion(j *Jurisdiction, region string) {
-	regions, ok := unknownRegionsByCountry[j.Alpha2]
+func (importer *Importer) unknownRegion(j *Jurisdiction, region string, d time.Time) {
+	key := fmt.Sprintf("%d/%s", j.Id(), region)
+	stats, ok := importer.unknownRegions[key]
 	if !ok {
-		regions = make([]string, 0)
+		stats = &unknownRegionStats{Country: j, Name: region}
+		importer.unknownRegions[key] = stats
 	}
-	regions = append(regions, region)
-	unknownRegionsByCountry[j.Alpha2] = regions
+	stats.seen(d)
 }
 
-func importRecord(mgr *grumble.EntityManager, d time.Time, r []string) (err error) {
-	var admin2 string
-	var provState string
-	var countryName string
-	switch len(r) {
-	case 6, 8:
-		provState = r[0]
-		countryName = r[1]
-		switch {
-		case provState == countryName:
-			provState = ""
-		case provState == "Chicago":
-			provState = "IL"
-		case provState == "Washington, D.C.":
-			provState = "DC"
-		case provState == "Taiwan":
-			provState = ""
-			countryName = "Taiwan"
-		case strings.HasSuffix(countryName, " SAR"):
-			provState = ""
-		}
-	default:
-		admin2 = r[1]
-		provState = r[2]
-		countryName = r[3]
+func importAdmin2() bool {
+	if admin2Iface, ok := handler.GetAppConfig()["admin2"]; ok {
+		return admin2Iface.(bool)
 	}
-	countryName = strings.TrimSpace(countryName)
-	provState = strings.TrimSpace(provState)
+	return true
+}
 
-	if provState == "None" || provState == "Unknown" {
-		provState = ""
+func isCounty(admin2 string) bool {
+	return admin2 != "Unassigned" && admin2 != "Unknown" && !strings.HasPrefix(admin2, "Out of ")
+}
+
+// Some reports drop the leading zero of FIPS codes or write them as floats.
+func normalizeFIPS(fips string) string {
+	fips = strings.TrimSuffix(strings.TrimSpace(fips), ".0")
+	if fips == "" {
+		return fips
 	}
-	if countryName == "Others" ||
-		provState == "Wuhan Evacuee" ||
-		strings.Contains(provState, "Recovered") ||
-		strings.Contains(provState, "Diamond Princess") ||
-		strings.Contains(countryName, "Diamond Princess") ||
-		strings.Contains(provState, "Grand Princess") ||
-		strings.Contains(countryName, "Grand Princess") ||
-		strings.Contains(provState, "MS Zaandam") ||
-		strings.Contains(countryName, "MS Zaandam") ||
-		strings.Contains(provState, "Cruise") ||
-		strings.Contains(countryName, "Cruise") {
-		// FIXME
-		return
+	if _, err := strconv.Atoi(fips); err != nil {
+		return fips
+	}
+	for len(fips) < 5 {
+		fips = "0" + fips
 	}
+	return fips
+}
 
-	if strings.HasSuffix(provState, ", Alberta") {
-		provState = "AB"
+func (importer *Importer) importRecord(d time.Time, rec *SampleRecord) (err error) {
+	mgr := importer.Manager
+	if rec.Err != nil {
+		return rowError(ErrorParse, "%v", rec.Err)
+	}
+	admin2 := rec.Admin2
+	provState := strings.TrimSpace(rec.ProvState)
+	countryName := strings.TrimSpace(rec.CountryName)
+	if provState == countryName {
+		provState = ""
 	}
 
-	if len(provState) > 4 && provState[len(provState)-4:len(provState)-2] == ", " {
-		provState = provState[len(provState)-2:]
+	rules, err := GetNormalizationRules()
+	if err != nil {
+		return
+	}
+	var action string
+	provState, countryName, action = rules.Normalize(provState, countryName)
+	switch action {
+	case ActionIgnore:
+		return
+	case ActionUnit:
+		var unit *Jurisdiction
+		if unit, err = GetUnit(mgr, countryName); err != nil {
+			return
+		}
+		_, err = importer.getSample(nil, d, unit, rec)
+		return
 	}
 
 	var c *Sample
 	if countryName == "" {
-		log.Printf("No country name in record %v", r)
-		return errors.New(fmt.Sprintf("No country name for %s %s", admin2, provState))
+		log.Printf("No country name in record %v", rec.Raw)
+		return rowError(ErrorNoCountry, "No country name for %s %s", admin2, provState)
 	}
 	country := GetJurisdiction(countryName)
 	if country == nil {
 		log.Printf("country for %q not found", countryName)
-		return errors.New(fmt.Sprintf("country for %q not found", countryName))
+		return rowError(ErrorUnknownCountry, "country for %q not found%s", countryName,
+			describeSuggestions(Registry.Suggest(nil, countryName, 3)))
 	}
-	c, err = getSample(mgr, nil, d, country, r)
+	c, err = importer.getSample(nil, d, country, rec)
 	if err != nil {
 		return
 	}
 
-	if provState != "" {
+	if provState == "" {
+		c.unassigned(rec)
+	} else {
 		region := country.GetRegion(provState)
 		if region != nil {
-			_, err = getSample(mgr, c, d, region, r)
+			var r *Sample
+			r, err = importer.getSample(c, d, region, rec)
 			if err != nil {
 				return
 			}
+			if admin2 = strings.TrimSpace(admin2); admin2 != "" && importAdmin2() && isCounty(admin2) {
+				var county *Jurisdiction
+				if county, err = region.GetCounty(mgr, admin2, normalizeFIPS(rec.FIPS)); err != nil {
+					return
+				}
+				if _, err = importer.getSample(r, d, county, rec); err != nil {
+					return
+				}
+			} else {
+				r.unassigned(rec)
+			}
 		} else {
-			unknownRegion(country, provState)
+			c.unassigned(rec)
+			importer.unknownRegion(country, provState, d)
 			//log.Printf("Region %q in country %q not found", provState, countryName)
 			//return errors.New(fmt.Sprintf("region %q in country %q not found", provState, countryName))
 		}
@@ -244,215 +473,495 @@ func putSample(s *Sample) (err error) {
 	return
 }
 
-func importSamples(mgr *grumble.EntityManager, from *time.Time, to *time.Time, save bool) (err error) {
-	var d time.Time
-	var end time.Time
+func isRootSample(s *Sample) bool {
+	return s.Parent() == nil || s.Parent() == grumble.ZeroKey
+}
 
-	if err = mgr.TX(func(db *sql.DB) (err error) {
-		_ = os.Mkdir("cache", 0777)
-		d = time.Date(2020, 1, 22, 0, 0, 0, 0, time.Local)
-		if from != nil {
-			d = *from
-		} else {
-			q := mgr.MakeQuery(ImportRecord{})
-			results, err := q.Execute()
-			if err != nil {
-				return err
-			}
-			for _, row := range results {
-				if importDate, err := time.Parse("01-02-2006", row[0].(*ImportRecord).JHUFile); err != nil {
-					return err
-				} else {
-					if importDate.After(d) {
-						d = importDate
-					}
-				}
-			}
-			d.AddDate(0, 0, 1)
+func rootSampleId(s *Sample) int {
+	k := s.AsKey()
+	for p := k.Parent(); p != nil && p != grumble.ZeroKey; p = p.Parent() {
+		k = p
+	}
+	return k.Id()
+}
+
+// replacedSamples returns the stored samples of the countries in the report,
+// and keeps the metrics other sources, like OWID, added to them.
+func replacedSamples(stored []*Sample, samples map[string]*Sample) (replaced []*Sample) {
+	byJurisdiction := make(map[int]*Sample, len(samples))
+	for _, s := range samples {
+		byJurisdiction[s.Jurisdiction.Id()] = s
+	}
+	roots := make(map[int]bool)
+	for _, old := range stored {
+		if !isRootSample(old) || old.Jurisdiction == nil {
+			continue
 		}
-		end = time.Now()
-		if to != nil {
-			end = *to
+		if s, ok := byJurisdiction[old.Jurisdiction.Id()]; ok {
+			s.copyMetrics(old)
+			roots[old.Id()] = true
 		}
+	}
+	replaced = make([]*Sample, 0)
+	for _, old := range stored {
+		if roots[rootSampleId(old)] {
+			replaced = append(replaced, old)
+		}
+	}
+	return
+}
+
+func (importer *Importer) replaceStoredSamples(d time.Time) (replaced []*Sample, err error) {
+	mgr := importer.Manager
+	q := mgr.MakeQuery(Sample{})
+	q.AddFilter("Date", d)
+	results, err := q.Execute()
+	if err != nil {
 		return
-	}); err != nil {
+	}
+	stored := make([]*Sample, 0, len(results))
+	for _, row := range results {
+		stored = append(stored, row[0].(*Sample))
+	}
+	replaced = replacedSamples(stored, importer.samples)
+	for _, s := range replaced {
+		if err = mgr.Delete(s); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func forgetImportErrors(mgr *grumble.EntityManager, fname string) (err error) {
+	q := mgr.MakeQuery(ImportError{})
+	q.AddFilter("File", fname)
+	results, err := q.Execute()
+	if err != nil {
 		return
 	}
-	for ; end.After(d); d, err = d.AddDate(0, 0, 1), nil {
-		samples = make(map[string]*Sample, 0)
+	for _, row := range results {
+		if err = mgr.Delete(row[0]); err != nil {
+			return
+		}
+	}
+	return
+}
 
-		var data []byte = nil
+type ImportProgress func(d time.Time, done int, total int, rows int, errors int)
 
-		fname := d.Format("01-02-2006")
+// importDate returns a MissingColumnError or database errors only. Reports
+// missing a column are not recorded, so they are imported once their layout
+// is supported.
+func (importer *Importer) importDate(report *fetchedReport, imp *ImportRecord) (good int, errorCount int, err error) {
+	importer.samples = make(map[string]*Sample)
+	mgr := importer.Manager
+	save := importer.Save
 
-		var ie grumble.Persistable
-		if err = mgr.TX(func(db *sql.DB) (err error) {
-			if ie, err = mgr.By(ImportRecord{}, "JHUFile", fname); err != nil {
-				log.Printf("Error finding import record for %q: %v", fname, err)
-				return
-			}
-			return
-		}); err != nil {
-			return
+	d := report.Date
+	fname := imp.JHUFile
+	revising := imp.State() == ImportImported
+	imp.Timestamp = time.Now()
+	imp.Attempts++
+
+	if err := report.FetchErr; err != nil {
+		log.Printf("Error downloading %q: %v", fname, err)
+		if revising || !save {
+			return 0, 0, nil
 		}
-		if ie != nil {
-			log.Printf("Data for %v already imported", d)
-			continue
+		status := ImportFailed
+		if isMissingReport(err) {
+			status = ImportMissing
 		}
+		imp.retryLater(status, err.Error())
+		return 0, 0, finishImportRecord(mgr, imp, nil)
+	}
+	hash := report.Hash
+	if report.Unchanged {
+		log.Printf("Report %q unchanged since last import", fname)
+		return
+	}
+
+	records := report.Records
+	if err := report.ParseErr; err != nil {
+		log.Printf("Error reading %s data for %q: %v", importer.Source.Name(), fname, err)
+		var missing *MissingColumnError
+		if errors.As(err, &missing) {
+			return 0, 1, fmt.Errorf("%s: %w", fname, err)
+		}
+		if revising || !save {
+			return 0, 1, nil
+		}
+		imp.Hash = hash
+		imp.Rejected = true
+		imp.retryLater(ImportFailed, err.Error())
+		return 0, 1, finishImportRecord(mgr, imp, nil)
+	}
 
-		useCache := false
-		if cacheIface, ok := handler.GetAppConfig()["usecache"]; ok {
-			useCache = cacheIface.(bool)
-		}
-		cachefile := fmt.Sprintf("cache/%s.csv", fname)
-		if useCache {
-			var f *os.File
-			f, err = os.Open(cachefile)
-			if err == nil {
-				log.Printf("Reading cache file %q", cachefile)
-				data, err = ioutil.ReadAll(f)
-				if err != nil {
-					log.Printf("Error reading cached report %q: %v", fname, err)
-					_ = os.Remove(cachefile)
-					data = nil
+	rowErrors := make([]*RowError, 0)
+	err = mgr.TX(func(db *sql.DB) error {
+		for _, rec := range records {
+			if err = importer.importRecord(d, rec); err != nil {
+				rowErr, ok := err.(*RowError)
+				if !ok {
+					rowErr = rowError(ErrorStorage, "%v", err)
 				}
-				_ = f.Close()
+				rowErr.Line = rec.Line
+				rowErr.Raw = rec.Raw
+				rowErrors = append(rowErrors, rowErr)
+				if rowErr.Category == ErrorParse {
+					// The parse error names the file and line already
+					log.Print(err)
+				} else {
+					log.Printf("%s:%d: %v", fname, rec.Line, err)
+				}
+			} else {
+				good++
 			}
 		}
-		if data == nil {
-			report := fmt.Sprintf(
-				"https://raw.github.com/CSSEGISandData/COVID-19/master/csse_covid_19_data/csse_covid_19_daily_reports/%s.csv",
-				fname)
-			data, err = download(report)
-			if err != nil {
-				log.Printf("Error downloading %q: %v", fname, err)
-				continue
+		return nil
+	})
+	errorCount = len(rowErrors)
+	for _, s := range importer.samples {
+		s.dropPartialMetrics()
+	}
+
+	rejected := len(records) > 0 && float64(errorCount)/float64(len(records)) > importTolerance()
+	switch {
+	case !save:
+		return
+	case revising && rejected:
+		log.Printf("Keeping previous import of %q: %d of %d rows of the revised report failed", fname, errorCount, len(records))
+		return
+	case revising:
+		err = importer.reviseImport(d, imp, hash, good, rowErrors)
+		return
+	case rejected:
+		log.Printf("Rejecting %q: %d of %d rows failed", fname, errorCount, len(records))
+		imp.retryLater(ImportFailed, fmt.Sprintf("%d of %d rows failed", errorCount, len(records)))
+	default:
+		err = mgr.TX(func(db *sql.DB) error {
+			if _, err = importer.replaceStoredSamples(d); err != nil {
+				return err
+			}
+			if err = setImportedDeltas(mgr, d, importer.samples); err != nil {
+				return err
 			}
-			if useCache {
-				f, err := os.Create(cachefile)
-				if err == nil {
-					_, _ = f.Write(data)
-					_ = f.Close()
+			for _, s := range importer.samples {
+				if err = putSample(s); err != nil {
+					return err
 				}
 			}
+			_, err = RecomputeDeltas(mgr, d.AddDate(0, 0, 1))
+			return err
+		})
+		if err != nil {
+			log.Printf("Error writing samples for %q: %v", fname, err)
+			rowErrors = append(rowErrors, rowError(ErrorStorage, "Error writing samples: %v", err))
+			rejected = true
+			imp.retryLater(ImportFailed, fmt.Sprintf("Error writing samples: %v", err))
+		} else {
+			imp.imported()
 		}
+	}
+	imp.Hash = hash
+	imp.Count = good
+	imp.Rejected = rejected
+	err = finishImportRecord(mgr, imp, rowErrors)
+	return
+}
 
-		r := csv.NewReader(bytes.NewReader(data))
-		var records [][]string
-		records, err = r.ReadAll()
+// reviseImport runs in a single transaction, so a failure leaves the previous
+// import intact.
+func (importer *Importer) reviseImport(d time.Time, imp *ImportRecord, hash string, good int, rowErrors []*RowError) (err error) {
+	mgr := importer.Manager
+	return mgr.TX(func(db *sql.DB) (err error) {
+		stored, err := storedTotals(mgr, d)
+		if err != nil {
+			return
+		}
+		replaced, err := importer.replaceStoredSamples(d)
 		if err != nil {
-			log.Printf("Error reading CSV data for %q: %v", fname, err)
-			if useCache {
-				_ = os.Remove(cachefile)
+			return
+		}
+		// Samples which are kept didn't change
+		old := make(map[int]*sampleTotals, len(replaced))
+		for _, s := range replaced {
+			if t, ok := stored[s.Jurisdiction.Id()]; ok {
+				old[s.Jurisdiction.Id()] = t
 			}
-			continue
 		}
-
-		errorCount := 0
-		good := 0
-		errorMessages := make([]string, 0)
-		err = mgr.TX(func(db *sql.DB) error {
-			for ix, r := range records[1:] {
-				if err = importRecord(mgr, d, r); err != nil {
-					s := fmt.Sprintf("%s:%d: %v", fname, ix+1, err)
-					errorMessages = append(errorMessages, s)
-					log.Print(s)
-					errorCount++
-				} else {
-					good++
-				}
+		if err = setImportedDeltas(mgr, d, importer.samples); err != nil {
+			return
+		}
+		for _, s := range importer.samples {
+			if err = putSample(s); err != nil {
+				return
 			}
-			return nil
-		})
+		}
+		if _, err = RecomputeDeltas(mgr, d.AddDate(0, 0, 1)); err != nil {
+			return
+		}
+		imp.Hash = hash
+		imp.Count = good
+		imp.Rejected = false
+		imp.imported()
+		if err = finishImportRecord(mgr, imp, rowErrors); err != nil {
+			return
+		}
+		changed, err := writeSampleRevisions(mgr, d, imp.JHUFile, old, importedTotals(importer.samples, nil))
+		if err != nil {
+			return
+		}
+		log.Printf("Revised %q: totals changed for %d jurisdictions", imp.JHUFile, changed)
+		return
+	})
+}
+
+func revalidateDays() int {
+	if daysIface, ok := handler.GetAppConfig()["revalidatedays"]; ok {
+		return int(daysIface.(float64))
+	}
+	return 7
+}
+
+func (importer *Importer) revising(d time.Time) bool {
+	return importer.Revise || !d.Before(utcDate(time.Now()).AddDate(0, 0, -revalidateDays()))
+}
+
+// Import imports the reports for the dates from up to but not including to.
+// It stops at the first report missing a required column.
+func (importer *Importer) Import(from *time.Time, to *time.Time) (err error) {
+	mgr := importer.Manager
+	start := JHUFirstReport
+	if from != nil {
+		start = utcDate(*from)
+	}
+	end := utcDate(time.Now()).AddDate(0, 0, 1)
+	if to != nil {
+		end = utcDate(*to)
+	}
+	if _, err = GetNormalizationRules(); err != nil {
+		return
+	}
+	records, err := importRecords(mgr)
+	if err != nil {
+		return
+	}
+	dates, err := importer.Source.Dates(start, end)
+	if err != nil {
+		return
+	}
 
-		if errorCount == 0 {
-			if save {
-				err = mgr.TX(func(db *sql.DB) error {
-					for _, s := range samples {
-						if err = putSample(s); err != nil {
-							return err
-						}
+	now := time.Now()
+	todo := make([]*ImportRecord, 0)
+	for _, d := range dates {
+		imp, ok := records[reportName(d)]
+		switch {
+		case !ok:
+			if imp, err = newImportRecord(mgr, d); err != nil {
+				return
+			}
+		case imp.State() == ImportImported && !importer.revising(d):
+			continue
+		case imp.State() != ImportImported && from == nil && imp.NextAttempt.After(now):
+			log.Printf("Not retrying %q before %v", imp.JHUFile, imp.NextAttempt)
+			continue
+		}
+		todo = append(todo, imp)
+	}
+	if importer.Save {
+		var locked []*ImportRecord
+		if locked, err = importer.lock(todo); err != nil {
+			return
+		}
+		defer importer.unlock(locked)
+		if records, err = importRecords(mgr); err != nil {
+			return
+		}
+		todo = stillPending(locked, records, importer.revising)
+		// Only the import holding the lock of a date creates its record
+		if err = mgr.TX(func(db *sql.DB) (err error) {
+			for _, imp := range todo {
+				if _, ok := records[imp.JHUFile]; !ok {
+					if err = mgr.Put(imp); err != nil {
+						return
 					}
-					return nil
-				})
-				if err != nil {
-					s := fmt.Sprintf("Error writing samples for %q: %v", fname, err)
-					errorMessages = append(errorMessages, s)
-					log.Printf(s)
 				}
 			}
+			return
+		}); err != nil {
+			return
+		}
+	}
+
+	requests := make([]fetchRequest, len(todo))
+	for ix, imp := range todo {
+		if requests[ix].Date, err = imp.Date(); err != nil {
+			return
+		}
+		requests[ix].Revising = imp.State() == ImportImported
+		if !importer.Force {
+			requests[ix].Hash = imp.Hash
+		}
+	}
+	fetcher := startReportFetcher(importer.Source, requests, importConcurrency())
+	defer fetcher.stop()
 
-			if ie, err = mgr.New(ImportRecord{}, grumble.ZeroKey); err != nil {
-				log.Printf("Error creating import record for %q: %v", fname, err)
+	var first, last *time.Time
+	var layoutErr error
+	for ix, imp := range todo {
+		report := fetcher.report(ix)
+		d := report.Date
+		var good, errorCount int
+		if good, errorCount, err = importer.importDate(report, imp); err != nil {
+			var missing *MissingColumnError
+			if !errors.As(err, &missing) {
 				return
-			} else {
-				imp := ie.(*ImportRecord)
-				imp.Timestamp = time.Now()
-				imp.JHUFile = fname
-				imp.Count = good
-				imp.ErrorCount = errorCount
-				imp.Errors = strings.Join(errorMessages, "\n")
-				if err = mgr.Put(imp); err != nil {
-					log.Printf("Error writing import record for %q: %v", fname, err)
-					return
-				}
 			}
+			// Later reports most likely have the same layout
+			layoutErr, err = err, nil
+			importer.Stats.Errors += errorCount
+			break
 		}
-	}
-	for country, regions := range unknownRegionsByCountry {
-		log.Printf("Unknown in %s", country)
-		for _, r := range regions {
-			log.Printf("\t%s", r)
+		importer.Stats.Dates++
+		importer.Stats.Rows += good
+		importer.Stats.Errors += errorCount
+		if imp.State() == ImportImported {
+			importer.Stats.Imported++
+			if first == nil || d.Before(*first) {
+				first = timePtr(d)
+			}
+			if last == nil || d.After(*last) {
+				last = timePtr(d)
+			}
+		}
+		if importer.Progress != nil {
+			importer.Progress(d, ix+1, len(todo), good, errorCount)
 		}
 	}
+	if err = importer.finish(first, last); err == nil {
+		err = layoutErr
+	}
 	return
 }
 
-func ImportRequest(res http.ResponseWriter, req *http.Request) {
-	mgr, err := grumble.MakeEntityManager()
+func (importer *Importer) finish(first *time.Time, last *time.Time) (err error) {
+	if !importer.Save {
+		return
+	}
+	mgr := importer.Manager
+	if err = persistUnknownRegions(mgr, importer.Source, importer.unknownRegions); err != nil || first == nil {
+		return
+	}
+	// The daily numbers of the day after the last imported date changed too
+	findings, err := CheckSamples(mgr, *first, last.AddDate(0, 0, 2), nil)
 	if err != nil {
-		http.Error(res, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	err = importSamples(mgr, nil, nil, true)
+	log.Printf("Checked samples from %s up to %s: %d findings", first.Format("2006-01-02"), last.Format("2006-01-02"), len(findings))
+	return
+}
+
+func dateParameter(req *http.Request, name string) (d *time.Time, err error) {
+	if s := req.FormValue(name); s != "" {
+		var t time.Time
+		if t, err = time.ParseInLocation("2006-01-02", s, time.UTC); err != nil {
+			return
+		}
+		d = &t
+	}
+	return
+}
+
+type importParameters struct {
+	Source string
+	Dir    string
+	From   *time.Time
+	To     *time.Time
+	Revise bool
+}
+
+func importRequestParameters(req *http.Request) (p importParameters, err error) {
+	p.Source = req.FormValue("source")
+	if p.Dir, err = dirParameter(req); err != nil {
+		return
+	}
+	if p.Dir == "" {
+		if _, err = GetSampleSource(p.Source); err != nil {
+			return
+		}
+	}
+	if p.From, err = dateParameter(req, "from"); err != nil {
+		return
+	}
+	if p.To, err = dateParameter(req, "to"); err != nil {
+		return
+	}
+	p.Revise = req.FormValue("revise") == "true"
+	return
+}
+
+func submitImportRequest(res http.ResponseWriter, req *http.Request, mgr *grumble.EntityManager, p importParameters) {
+	job, err := SubmitImportJob(mgr, p.Source, p.Dir, p.From, p.To, p.Revise, false)
 	if err != nil {
-		http.Error(res, err.Error(), http.StatusInternalServerError)
+		submitJobError(res, err)
 		return
 	}
-	http.Redirect(res, req, "/index.html", http.StatusTemporaryRedirect)
+	http.Redirect(res, req, fmt.Sprintf("/import/status?job=%d", job.Id()), http.StatusSeeOther)
 }
 
-func RebuildRequest(res http.ResponseWriter, req *http.Request) {
-	if req.FormValue("magic") != "DEADBEEF" {
-		http.Error(res, "Missing magic value", http.StatusInternalServerError)
+func dirParameter(req *http.Request) (dir string, err error) {
+	if dir = req.FormValue("dir"); dir == "" {
+		return
 	}
-	mgr, err := grumble.MakeEntityManager()
+	return requestImportDir(importDir(), dir)
+}
+
+func ImportRequest(res http.ResponseWriter, req *http.Request) {
+	p, err := importRequestParameters(req)
 	if err != nil {
-		http.Error(res, err.Error(), http.StatusInternalServerError)
+		http.Error(res, err.Error(), http.StatusBadRequest)
 		return
 	}
-	ClearCaches()
-	if err = grumble.GetKind(Jurisdiction{}).Truncate(mgr.PostgreSQLAdapter); err != nil {
+	mgr, err := grumble.MakeEntityManager()
+	if err != nil {
 		http.Error(res, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if err = grumble.GetKind(Sample{}).Truncate(mgr.PostgreSQLAdapter); err != nil {
-		http.Error(res, err.Error(), http.StatusInternalServerError)
+	submitImportRequest(res, req, mgr, p)
+}
+
+// Rebuild empties the tables and recreates the jurisdictions. The samples need
+// to be re-imported afterwards.
+func Rebuild(mgr *grumble.EntityManager) (err error) {
+	Registry.Clear()
+	for _, e := range []interface{}{Jurisdiction{}, Sample{}, ImportRecord{}, ImportError{}, UnknownRegion{}, SampleRevision{}, Finding{}, ImportLock{}, ImportJob{}} {
+		if err = grumble.GetKind(e).Truncate(mgr.PostgreSQLAdapter); err != nil {
+			return
+		}
+	}
+	return SyncCountries()
+}
+
+func RebuildRequest(res http.ResponseWriter, req *http.Request) {
+	if req.FormValue("magic") != "DEADBEEF" {
+		http.Error(res, "Missing magic value", http.StatusInternalServerError)
 		return
 	}
-	if err = grumble.GetKind(ImportRecord{}).Truncate(mgr.PostgreSQLAdapter); err != nil {
-		http.Error(res, err.Error(), http.StatusInternalServerError)
+	// Validate before the tables are truncated
+	p, err := importRequestParameters(req)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
 		return
 	}
-	err = SyncCountries()
+	mgr, err := grumble.MakeEntityManager()
 	if err != nil {
 		http.Error(res, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	err = importSamples(mgr, nil, nil, true)
-	if err != nil {
+	if err = Rebuild(mgr); err != nil {
 		http.Error(res, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	http.Redirect(res, req, "/index.html", http.StatusTemporaryRedirect)
+	submitImportRequest(res, req, mgr, p)
 }
@@ -0,0 +1,117 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2020 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package app
+
+import (
+	"errors"
+	"github.com/JanDeVisser/grumble"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseJHUReportLines(t *testing.T) {
+	data := "Province_State,Country_Region,Confirmed,Deaths\n" +
+		",Netherlands,10,1\n" +
+		"\"Multi\nLine\",France,20,2\n" +
+		",Belgium,many,3\n"
+	records, err := parseJHUReport("04-01-2020.csv", []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("%d records, expected 3", len(records))
+	}
+	for ix, line := range []int{2, 3, 5} {
+		if records[ix].Line != line {
+			t.Errorf("record %d is on line %d, expected %d", ix, records[ix].Line, line)
+		}
+	}
+	var parseErr *ParseError
+	if !errors.As(records[2].Err, &parseErr) || parseErr.Line != 5 || parseErr.Column != 3 {
+		t.Errorf("error for invalid number: %v", records[2].Err)
+	}
+}
+
+func TestParseJHUReportNewColumns(t *testing.T) {
+	data := "Province_State,Country_Region,Confirmed,Deaths,Active,Incident_Rate,Case-Fatality_Ratio\n" +
+		",Netherlands,10,1,9,57.3,10.0\n" +
+		",France,20,2,n/a,,\n"
+	records, err := parseJHUReport("06-01-2020.csv", []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nl := records[0]; nl.Err != nil || nl.Active != 9 || nl.IncidentRate != 57.3 || nl.CaseFatalityRatio != 10.0 {
+		t.Errorf("Netherlands %+v", nl)
+	}
+	var parseErr *ParseError
+	if !errors.As(records[1].Err, &parseErr) || parseErr.Header != "Active" {
+		t.Errorf("error for invalid active count: %v", records[1].Err)
+	}
+}
+
+func TestParseJHUReportMissingColumn(t *testing.T) {
+	_, err := parseJHUReport("06-01-2020.csv", []byte("Province_State,Country_Region,Confirmed\n,Netherlands,10\n"))
+	var missing *MissingColumnError
+	if !errors.As(err, &missing) || missing.Column != jhuDeaths {
+		t.Errorf("got error %v, expected deaths column missing", err)
+	}
+}
+
+func TestReplacedSamplesKeepsOtherSources(t *testing.T) {
+	nl := testJurisdiction(1, "Netherlands")
+	be := testJurisdiction(2, "Belgium")
+	tests, vaccinations := GetMetric("tests"), GetMetric("vaccinations")
+
+	// A revised report for a date holding the JHU sample for the
+	// Netherlands, with OWID metrics merged in, and an OWID-only sample for
+	// Belgium
+	jhu := &Sample{Jurisdiction: nl, Confirmed: 10}
+	jhu.Key = grumble.Key{Ident: 10}
+	tests.Set(jhu, 100)
+	owid := &Sample{Jurisdiction: be}
+	owid.Key = grumble.Key{Ident: 11}
+	vaccinations.Set(owid, 5)
+	revised := &Sample{Jurisdiction: nl, Confirmed: 12}
+
+	replaced := replacedSamples([]*Sample{jhu, owid}, map[string]*Sample{"Netherlands": revised})
+	if len(replaced) != 1 || replaced[0] != jhu {
+		t.Fatalf("replaced %v, expected only the sample for the Netherlands", replaced)
+	}
+	if value, ok := tests.Value(revised); !ok || value != 100 {
+		t.Errorf("tests of the revised sample are %d, expected 100", value)
+	}
+}
+
+func TestImportRequestParameters(t *testing.T) {
+	for query, valid := range map[string]bool{
+		"source=jhu&from=2020-04-01&to=2020-05-01": true,
+		"source=jhu&revise=true":                   true,
+		"source=nosuch":                            false,
+		"source=jhu&from=2020-13-01":               false,
+		"source=jhu&to=yesterday":                  false,
+	} {
+		p, err := importRequestParameters(httptest.NewRequest("POST", "/rebuild?"+query, nil))
+		if valid && err != nil {
+			t.Errorf("%s: %v", query, err)
+		} else if !valid && err == nil {
+			t.Errorf("%s: accepted %+v", query, p)
+		}
+	}
+}
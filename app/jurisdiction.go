@@ -20,47 +20,34 @@
 package app
 
 import (
-	"database/sql"
 	"errors"
 	"fmt"
 	"github.com/JanDeVisser/grumble"
 	"log"
 	"net/http"
 	"net/url"
-	"strconv"
 	"strings"
 	"time"
 )
 
 type Jurisdiction struct {
 	grumble.Key
-	Name         string
-	Alpha2       string `grumble:"verbose_name=ISO-3166-2 Code"`
-	Alpha3       string `grumble:"verbose_name=ISO-3166-3 Code"`
-	Alias        string
-	Aliases      []string
-	regions      map[string]*Jurisdiction
-	Population   int64
-	MedianAge    float64 `grumble:"verbose_name=Median Age"`
-	GDPPerCapPPP float64 `grumble:"verbose_name=GDP per capita w/ purchasing parity"`
+	Name          string
+	Alpha2        string `grumble:"verbose_name=ISO-3166-2 Code"`
+	Alpha3        string `grumble:"verbose_name=ISO-3166-3 Code"`
+	FIPS          string `grumble:"verbose_name=FIPS Code"`
+	Alias         string
+	Aliases       []string
+	Population    int64
+	MedianAge     float64 `grumble:"verbose_name=Median Age"`
+	GDPPerCapPPP  float64 `grumble:"verbose_name=GDP per capita w/ purchasing parity"`
+	Manual        bool    `grumble:"verbose_name=Created manually"`
+	NonGeographic bool    `grumble:"verbose_name=Non-geographic unit"`
+	tx            *RegistryTX
 }
 
-var jurisdictionsByName = make(map[string]*Jurisdiction, 0)
-var jurisdictions = make(map[int]*Jurisdiction, 0)
-
-var regionsForId = make(map[int][]*Jurisdiction, 0)
-
 func CacheJurisdictions(mgr *grumble.EntityManager) (err error) {
-	ClearCaches()
-	q := mgr.MakeQuery(Jurisdiction{})
-	_, err = q.Execute()
-	return
-}
-
-func ClearCaches() {
-	jurisdictionsByName = make(map[string]*Jurisdiction, 0)
-	jurisdictions = make(map[int]*Jurisdiction, 0)
-	regionsForId = make(map[int][]*Jurisdiction, 0)
+	return Registry.Reload(mgr)
 }
 
 func persistJurisdictions(regions []Region) (err error) {
@@ -72,16 +59,16 @@ func persistJurisdictions(regions []Region) (err error) {
 	if err != nil {
 		return
 	}
-	if err = mgr.TX(func(conn *sql.DB) (err error) {
+	if err = Registry.TX(mgr, func(tx *RegistryTX) (err error) {
 		for _, c := range regions {
-			if j, ok := jurisdictionsByName[c.Name]; ok {
+			if j := Registry.ByName(c.Name); j != nil {
 				if j.Name == c.Name {
-					if err = j.Sync(&c); err != nil {
+					if err = j.Copy().Sync(tx, &c); err != nil {
 						return
 					}
 				}
 			} else {
-				if j, err = c.Persist(mgr, nil); err != nil {
+				if j, err = c.Persist(tx, nil); err != nil {
 					return
 				}
 			}
@@ -93,131 +80,157 @@ func persistJurisdictions(regions []Region) (err error) {
 	return CacheJurisdictions(mgr)
 }
 
-func (jurisdiction *Jurisdiction) Cache() {
-	if _, ok := jurisdictions[jurisdiction.Id()]; !ok {
-		jurisdictions[jurisdiction.Id()] = jurisdiction
-	}
-
-	var m map[string]*Jurisdiction = nil
-	if jurisdiction.Parent() != nil && jurisdiction.Parent() != grumble.ZeroKey {
-		pid := jurisdiction.Parent().Id()
-		if p, ok := jurisdictions[pid]; ok {
-			m = p.regions
-		} else {
-			regions, ok := regionsForId[pid]
-			if !ok {
-				regions = make([]*Jurisdiction, 0)
-			}
-			regionsForId[pid] = append(regions, jurisdiction)
-		}
-	} else {
-		m = jurisdictionsByName
-	}
-	if m != nil {
-		if _, ok := m[jurisdiction.Name]; !ok {
-			m[jurisdiction.Name] = jurisdiction
-			m[strconv.FormatInt(int64(jurisdiction.Ident), 10)] = jurisdiction
-			if jurisdiction.Alpha2 != "" {
-				m[jurisdiction.Alpha2] = jurisdiction
-			}
-			if jurisdiction.Alpha3 != "" {
-				m[jurisdiction.Alpha3] = jurisdiction
-			}
-			for _, alias := range jurisdiction.Aliases {
-				m[alias] = jurisdiction
-			}
-		}
-	}
-	delete(regionsForId, jurisdiction.Id())
-}
-
-func (jurisdiction *Jurisdiction) Uncache() {
-	var m map[string]*Jurisdiction = nil
-	if jurisdiction.Parent() != nil && jurisdiction.Parent() != grumble.ZeroKey {
-		if p, ok := jurisdictions[jurisdiction.Parent().Id()]; ok {
-			m = p.regions
-		}
-	} else {
-		m = jurisdictionsByName
-	}
-	if m != nil {
-		delete(m, jurisdiction.Name)
-		delete(m, strconv.FormatInt(int64(jurisdiction.Ident), 10))
-		if jurisdiction.Alpha2 != "" {
-			delete(m, jurisdiction.Alpha2)
-		}
-		if jurisdiction.Alpha3 != "" {
-			delete(m, jurisdiction.Alpha3)
-		}
-		for _, alias := range jurisdiction.Aliases {
-			delete(m, alias)
-		}
-	}
-	delete(jurisdictions, jurisdiction.Id())
-}
-
-func (jurisdiction *Jurisdiction) Sync(region *Region) (err error) {
+func (jurisdiction *Jurisdiction) Sync(tx *RegistryTX, region *Region) (err error) {
 	log.Printf("Syncing %q", jurisdiction.Name)
-	jurisdiction.Uncache()
 	jurisdiction.Name = region.Name
 	jurisdiction.Alpha2 = region.Alpha2
 	jurisdiction.Alpha3 = region.Alpha3
+	if region.FIPS != "" {
+		jurisdiction.FIPS = region.FIPS
+	}
 	jurisdiction.Population = region.Population
 	jurisdiction.MedianAge = region.MedianAge
 	jurisdiction.GDPPerCapPPP = region.GDPPerCapPPP
-	jurisdiction.Aliases = make([]string, len(region.Alias))
-	copy(jurisdiction.Aliases, region.Alias)
-	if err = jurisdiction.Manager().Put(jurisdiction); err != nil {
+	jurisdiction.Aliases = mergeAliases(region.Alias, jurisdiction.Aliases)
+	if err = tx.Put(jurisdiction); err != nil {
 		return err
 	}
 
-	if err = jurisdiction.Manager().Put(jurisdiction); err != nil {
+	if err = tx.Put(jurisdiction); err != nil {
 		return
 	}
 	regions := make(map[string]bool, 0)
 	for _, sub := range region.Regions {
-		if subj, ok := jurisdiction.regions[sub.Name]; !ok {
-			subj, err = sub.Persist(jurisdiction.Manager(), jurisdiction)
+		if subj := Registry.Region(jurisdiction, sub.Name); subj == nil {
+			subj, err = sub.Persist(tx, jurisdiction)
 		} else {
-			err = subj.Sync(&sub)
+			err = subj.Copy().Sync(tx, &sub)
 		}
 		if err != nil {
 			return err
 		}
 		regions[sub.Name] = true
 	}
-	for name, subj := range jurisdiction.regions {
-		if _, ok := regions[name]; !ok {
-			delete(jurisdiction.regions, name)
-			if err = jurisdiction.Manager().Delete(subj); err != nil {
+	for _, subj := range jurisdiction.Regions() {
+		if _, ok := regions[subj.Name]; !ok && !subj.Manual {
+			if err = tx.Delete(subj.Copy()); err != nil {
 				return
 			}
 		}
 	}
-	jurisdiction.Cache()
+	return
+}
+
+// mergeAliases keeps the aliases added through the admin pages.
+func mergeAliases(aliases []string, existing []string) (merged []string) {
+	merged = make([]string, 0, len(aliases)+len(existing))
+	seen := make(map[string]bool)
+	for _, list := range [][]string{aliases, existing} {
+		for _, alias := range list {
+			if !seen[alias] {
+				seen[alias] = true
+				merged = append(merged, alias)
+			}
+		}
+	}
 	return
 }
 
 func GetJurisdiction(name string) (ret *Jurisdiction) {
-	if id, err := strconv.ParseInt(name, 10, 64); err == nil {
-		return jurisdictions[int(id)]
-	} else {
-		return jurisdictionsByName[name]
+	return Registry.Lookup(name)
+}
+
+// GetUnit returns the non-geographic reporting unit, like a cruise ship, with
+// the given name, creating it if needed.
+func GetUnit(mgr *grumble.EntityManager, name string) (unit *Jurisdiction, err error) {
+	if unit = GetJurisdiction(name); unit != nil {
+		return
+	}
+	log.Printf("Creating non-geographic unit %q", name)
+	e, err := mgr.New(Jurisdiction{}, grumble.ZeroKey)
+	if err != nil {
+		return
 	}
+	unit = e.(*Jurisdiction)
+	unit.Name = name
+	unit.Manual = true
+	unit.NonGeographic = true
+	if err = mgr.Put(unit); err != nil {
+		return
+	}
+	Registry.Update(unit)
+	return
 }
 
+func NonGeographicUnits() (units []grumble.Persistable) {
+	units = make([]grumble.Persistable, 0)
+	for _, j := range Registry.All() {
+		if j.NonGeographic {
+			units = append(units, j)
+		}
+	}
+	return
+}
+
+func (jurisdiction *Jurisdiction) Regions() []*Jurisdiction {
+	return Registry.Regions(jurisdiction)
+}
+
+// GetRegion falls back to the non-geographic unit with exactly that name.
 func (jurisdiction *Jurisdiction) GetRegion(name string) (ret *Jurisdiction) {
-	ret = jurisdiction.regions[name]
+	ret = Registry.Resolve(jurisdiction, name)
 	if ret == nil {
-		ret = GetJurisdiction(name)
+		if unit := Registry.ByName(name); unit != nil && unit.NonGeographic {
+			ret = unit
+		}
 	}
 	return
 }
 
+func (jurisdiction *Jurisdiction) GetCounty(mgr *grumble.EntityManager, name string, fips string) (county *Jurisdiction, err error) {
+	if fips != "" {
+		if county = Registry.ByFIPS(fips); county != nil {
+			return
+		}
+	}
+	if county = Registry.Region(jurisdiction, name); county != nil {
+		if fips != "" && county.FIPS == "" {
+			county = county.Copy()
+			county.FIPS = fips
+			if err = mgr.Put(county); err != nil {
+				return
+			}
+			Registry.Update(county)
+		}
+		return
+	}
+	r := Region{Name: name, FIPS: fips}
+	if county, err = r.makeJurisdiction(mgr, jurisdiction); err != nil {
+		return
+	}
+	county.Manual = true
+	if err = mgr.Put(county); err != nil {
+		return
+	}
+	// Cache the county, so the next row for it doesn't create another one
+	Registry.Update(county)
+	return
+}
+
 func (jurisdiction *Jurisdiction) GetFlag(size string) (flagURL string) {
+	if jurisdiction.NonGeographic {
+		return ""
+	}
 	pdir := ""
 	if jurisdiction.Parent() != grumble.ZeroKey && jurisdiction.Parent() != nil {
-		p := jurisdictions[jurisdiction.Parent().Id()]
+		p := Registry.ById(jurisdiction.Parent().Id())
+		if p == nil {
+			return fmt.Sprintf("/image/flags/%s/%s.png", size, "aq")
+		}
+		if p.Parent() != grumble.ZeroKey && p.Parent() != nil {
+			// Counties don't have flags of their own
+			return p.GetFlag(size)
+		}
 		pdir = strings.ToLower(fmt.Sprintf("%s/", p.Alpha2))
 	}
 	return fmt.Sprintf("/image/flags/%s/%s%s.png", size, pdir, strings.ToLower(jurisdiction.Alpha2))
@@ -226,13 +239,13 @@ func (jurisdiction *Jurisdiction) GetFlag(size string) (flagURL string) {
 func (jurisdiction *Jurisdiction) TopRegions(number int, cases bool, exclude []string) (regions []grumble.Persistable, err error) {
 	excludes := make(map[int]bool, len(exclude))
 	for _, excl := range exclude {
-		if e, ok := jurisdiction.regions[excl]; ok {
+		if e := Registry.Resolve(jurisdiction, excl); e != nil {
 			excludes[e.Id()] = true
 		}
 	}
 	q := jurisdiction.Manager().MakeQuery(Sample{})
 	allRegions := make([]grumble.Persistable, 0)
-	for _, r := range jurisdiction.regions {
+	for _, r := range jurisdiction.Regions() {
 		if _, ok := excludes[r.Id()]; !ok {
 			allRegions = append(allRegions, r)
 		}
@@ -265,11 +278,6 @@ func (jurisdiction *Jurisdiction) OnGet() (ret grumble.Persistable, err error) {
 	if jurisdiction.Alias != "" {
 		jurisdiction.Aliases = strings.Split(jurisdiction.Alias, ";")
 	}
-	if cached, ok := jurisdictions[jurisdiction.Id()]; ok {
-		jurisdiction.regions = cached.regions
-	} else {
-		jurisdiction.Cache()
-	}
 	return
 }
 
@@ -282,12 +290,32 @@ func (jurisdiction *Jurisdiction) OnPut() (err error) {
 	return
 }
 
+// AfterPut picks up changes made through the entity pages. Jurisdictions
+// stored through a RegistryTX are updated when it commits.
 func (jurisdiction *Jurisdiction) AfterPut() (err error) {
+	if jurisdiction.tx == nil {
+		Registry.Update(jurisdiction)
+	}
+	return
+}
+
+func (jurisdiction *Jurisdiction) AfterDelete() (err error) {
+	if jurisdiction.tx == nil {
+		Registry.Remove(jurisdiction)
+	}
 	return
 }
 
+func (jurisdiction *Jurisdiction) Copy() *Jurisdiction {
+	c := *jurisdiction
+	c.tx = nil
+	if jurisdiction.Aliases != nil {
+		c.Aliases = append(make([]string, 0, len(jurisdiction.Aliases)), jurisdiction.Aliases...)
+	}
+	return &c
+}
+
 func (jurisdiction *Jurisdiction) AfterCreate() (err error) {
-	jurisdiction.regions = make(map[string]*Jurisdiction, 0)
 	jurisdiction.Aliases = make([]string, 0)
 	return
 }
@@ -314,7 +342,13 @@ func (jurisdiction *Jurisdiction) MakeContext(data map[string]interface{}) (err
 	data["Include"] = parameters.Get("include")
 	data["Cases"] = parameters.Get("cases")
 	data["Deaths"] = parameters.Get("deaths")
+	data["Recovered"] = seriesChartType(parameters.Get("recovered"))
+	data["Active"] = seriesChartType(parameters.Get("active"))
+	data["Gaps"] = parameters.Get("gaps")
 	data["Regression"] = parameters.Get("regression")
+	data["Metric"] = parameters.Get("metric")
+	data["MetricType"] = parameters.Get("metrictype")
+	data["metrics"] = Metrics
 
 	data["RExclude"] = parameters.Get("rexclude")
 	data["RInclude"] = parameters.Get("rinclude")
@@ -322,7 +356,7 @@ func (jurisdiction *Jurisdiction) MakeContext(data map[string]interface{}) (err
 	data["RDeaths"] = parameters.Get("rdeaths")
 	data["RRegression"] = parameters.Get("rregression")
 
-	if len(jurisdiction.regions) > 0 {
+	if len(jurisdiction.Regions()) > 0 {
 		sampleQ := jurisdiction.Manager().MakeQuery(Sample{})
 		sampleQ.AddFilter("Date", d)
 		sampleQ.AddCondition(&grumble.References{
@@ -363,15 +397,6 @@ func (jurisdiction *Jurisdiction) MakeContext(data map[string]interface{}) (err
 	})
 	q.AddSort(grumble.Sort{Column: "Date", Direction: "DESC"})
 	results, err := q.Execute()
-	cases := 0
-	deaths := 0
-	for ix := range results {
-		s := results[len(results)-ix-1][0].(*Sample)
-		s.NewConfirmed = s.Confirmed - cases
-		cases = s.Confirmed
-		s.NewDeceased = s.Deceased - deaths
-		deaths = s.Deceased
-	}
 	if err != nil {
 		return err
 	}
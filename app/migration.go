@@ -0,0 +1,143 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2020 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package app
+
+import (
+	"database/sql"
+	"github.com/JanDeVisser/grumble"
+	"log"
+	"time"
+)
+
+type Migration struct {
+	grumble.Key
+	Name    string
+	Applied time.Time
+}
+
+type migration struct {
+	Name  string
+	Apply func(mgr *grumble.EntityManager) error
+}
+
+// Add new migrations at the end, and never rename one that was released.
+var migrations = []migration{
+	// Dates used to be stored as midnight local time
+	{Name: "utc-dates", Apply: migrateUTCDates},
+	// Samples stored before the daily numbers were computed have them all 0
+	{Name: "recompute-deltas", Apply: func(mgr *grumble.EntityManager) error {
+		return RecomputeAllDeltas(mgr, nil, nil, nil)
+	}},
+}
+
+func Migrate(mgr *grumble.EntityManager) (err error) {
+	for _, m := range migrations {
+		var e grumble.Persistable
+		if e, err = mgr.By(Migration{}, "Name", m.Name); err != nil {
+			return
+		}
+		if e != nil {
+			continue
+		}
+		log.Printf("Applying migration %q", m.Name)
+		if err = m.Apply(mgr); err != nil {
+			return
+		}
+		if e, err = mgr.New(Migration{}, grumble.ZeroKey); err != nil {
+			return
+		}
+		applied := e.(*Migration)
+		applied.Name = m.Name
+		applied.Applied = time.Now()
+		if err = mgr.Put(applied); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func legacyDate(t time.Time) (time.Time, bool) {
+	if u := t.UTC(); u.Equal(utcDate(u)) {
+		return u, false
+	}
+	l := t.In(time.Local)
+	return time.Date(l.Year(), l.Month(), l.Day(), 0, 0, 0, 0, time.UTC), true
+}
+
+var dateColumns = []struct {
+	entity interface{}
+	dates  func(e grumble.Persistable) []*time.Time
+}{
+	{Sample{}, func(e grumble.Persistable) []*time.Time {
+		return []*time.Time{&e.(*Sample).Date}
+	}},
+	{Finding{}, func(e grumble.Persistable) []*time.Time {
+		return []*time.Time{&e.(*Finding).Date}
+	}},
+	{SampleRevision{}, func(e grumble.Persistable) []*time.Time {
+		return []*time.Time{&e.(*SampleRevision).Date}
+	}},
+	{UnknownRegion{}, func(e grumble.Persistable) []*time.Time {
+		ur := e.(*UnknownRegion)
+		return []*time.Time{&ur.FirstSeen, &ur.LastSeen}
+	}},
+	{ImportJob{}, func(e grumble.Persistable) []*time.Time {
+		job := e.(*ImportJob)
+		return []*time.Time{&job.From, &job.To, &job.CurrentDate}
+	}},
+}
+
+func migrateUTCDates(mgr *grumble.EntityManager) (err error) {
+	for _, columns := range dateColumns {
+		q := mgr.MakeQuery(columns.entity)
+		var results [][]grumble.Persistable
+		if results, err = q.Execute(); err != nil {
+			return
+		}
+		count := 0
+		err = mgr.TX(func(db *sql.DB) (err error) {
+			for _, row := range results {
+				changed := false
+				for _, d := range columns.dates(row[0]) {
+					if d.IsZero() {
+						continue
+					}
+					var c bool
+					if *d, c = legacyDate(*d); c {
+						changed = true
+					}
+				}
+				if !changed {
+					continue
+				}
+				if err = mgr.Put(row[0]); err != nil {
+					return
+				}
+				count++
+			}
+			return
+		})
+		if err != nil {
+			return
+		}
+		log.Printf("Normalized the dates of %d of %d %T entities", count, len(results), columns.entity)
+	}
+	return
+}
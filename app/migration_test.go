@@ -0,0 +1,43 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2020 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLegacyDate(t *testing.T) {
+	saved := time.Local
+	defer func() {
+		time.Local = saved
+	}()
+	want := time.Date(2020, 4, 1, 0, 0, 0, 0, time.UTC)
+	for _, offset := range []int{-7, 0, 2, 10} {
+		time.Local = time.FixedZone("test", offset*60*60)
+		local := time.Date(2020, 4, 1, 0, 0, 0, 0, time.Local)
+		if d, _ := legacyDate(local); !d.Equal(want) {
+			t.Errorf("UTC%+d: local midnight %v became %v, expected %v", offset, local, d, want)
+		}
+		if d, changed := legacyDate(want); changed || !d.Equal(want) {
+			t.Errorf("UTC%+d: UTC midnight %v became %v", offset, want, d)
+		}
+	}
+}
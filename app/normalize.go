@@ -0,0 +1,235 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2020 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/JanDeVisser/grumble/handler"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	MatchExact    = "exact"
+	MatchPrefix   = "prefix"
+	MatchSuffix   = "suffix"
+	MatchContains = "contains"
+	MatchRegex    = "regex"
+)
+
+const (
+	FieldProvince = "province"
+	FieldCountry  = "country"
+	FieldAny      = "any"
+)
+
+const (
+	ActionRewrite = "rewrite"
+	ActionIgnore  = "ignore"
+	ActionUnit    = "unit"
+)
+
+// NormalizationRule rewrites or drops report rows based on their province or
+// country name. Rules see the names as rewritten by the rules before them.
+type NormalizationRule struct {
+	Scope    string  `json:"scope,omitempty"`
+	Field    string  `json:"field"`
+	Match    string  `json:"match"`
+	Pattern  string  `json:"pattern"`
+	Action   string  `json:"action"`
+	Province *string `json:"province,omitempty"`
+	Country  *string `json:"country,omitempty"`
+	Unit     string  `json:"unit,omitempty"`
+	Comment  string  `json:"comment,omitempty"`
+	re       *regexp.Regexp
+}
+
+type NormalizationRules struct {
+	Rules []*NormalizationRule `json:"rules"`
+}
+
+var normalizationRules *NormalizationRules
+var normalizationMutex sync.RWMutex
+
+func normalizationRulesFile() string {
+	if fileIface, ok := handler.GetAppConfig()["normalizerules"]; ok {
+		return fileIface.(string)
+	}
+	return "conf/normalize.json"
+}
+
+func ReadNormalizationRules(fileName string) (rules *NormalizationRules, err error) {
+	jsonText, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return
+	}
+	rules = &NormalizationRules{}
+	if err = json.Unmarshal(jsonText, rules); err != nil {
+		return
+	}
+	for ix, rule := range rules.Rules {
+		if err = rule.compile(); err != nil {
+			err = fmt.Errorf("%s: rule %d: %v", fileName, ix+1, err)
+			return
+		}
+	}
+	return
+}
+
+func LoadNormalizationRules() (err error) {
+	fileName := normalizationRulesFile()
+	log.Printf("Reading normalization rules from %q", fileName)
+	rules, err := ReadNormalizationRules(fileName)
+	if err != nil {
+		return
+	}
+	normalizationMutex.Lock()
+	defer normalizationMutex.Unlock()
+	normalizationRules = rules
+	return
+}
+
+func GetNormalizationRules() (rules *NormalizationRules, err error) {
+	normalizationMutex.RLock()
+	rules = normalizationRules
+	normalizationMutex.RUnlock()
+	if rules == nil {
+		if err = LoadNormalizationRules(); err != nil {
+			return
+		}
+		return GetNormalizationRules()
+	}
+	return
+}
+
+func (rule *NormalizationRule) compile() (err error) {
+	switch rule.Field {
+	case FieldProvince, FieldCountry, FieldAny:
+	default:
+		return fmt.Errorf("invalid field %q", rule.Field)
+	}
+	switch rule.Action {
+	case ActionRewrite, ActionIgnore:
+	case ActionUnit:
+		if rule.Unit == "" {
+			return fmt.Errorf("unit rule without unit name")
+		}
+	default:
+		return fmt.Errorf("invalid action %q", rule.Action)
+	}
+	switch rule.Match {
+	case MatchExact, MatchPrefix, MatchSuffix, MatchContains:
+	case MatchRegex:
+		rule.re, err = regexp.Compile(rule.Pattern)
+	default:
+		err = fmt.Errorf("invalid match type %q", rule.Match)
+	}
+	return
+}
+
+func (rule *NormalizationRule) inScope(countryName string) bool {
+	if rule.Scope == "" || rule.Scope == countryName {
+		return true
+	}
+	scope := GetJurisdiction(rule.Scope)
+	return scope != nil && scope == GetJurisdiction(countryName)
+}
+
+func (rule *NormalizationRule) matches(value string) []int {
+	matched := false
+	switch rule.Match {
+	case MatchExact:
+		matched = value == rule.Pattern
+	case MatchPrefix:
+		matched = strings.HasPrefix(value, rule.Pattern)
+	case MatchSuffix:
+		matched = strings.HasSuffix(value, rule.Pattern)
+	case MatchContains:
+		matched = strings.Contains(value, rule.Pattern)
+	case MatchRegex:
+		return rule.re.FindStringSubmatchIndex(value)
+	}
+	if matched {
+		return []int{0, len(value)}
+	}
+	return nil
+}
+
+func (rule *NormalizationRule) rewrite(template *string, value string, submatches []int, current string) string {
+	if template == nil {
+		return current
+	}
+	if rule.re == nil {
+		return *template
+	}
+	return string(rule.re.ExpandString(nil, *template, value, submatches))
+}
+
+func (rule *NormalizationRule) apply(provState string, countryName string) (string, string, string) {
+	if !rule.inScope(countryName) {
+		return provState, countryName, ""
+	}
+	value := ""
+	var submatches []int
+	if rule.Field == FieldProvince || rule.Field == FieldAny {
+		value = provState
+		submatches = rule.matches(provState)
+	}
+	if submatches == nil && (rule.Field == FieldCountry || rule.Field == FieldAny) {
+		value = countryName
+		submatches = rule.matches(countryName)
+	}
+	switch {
+	case submatches == nil:
+		return provState, countryName, ""
+	case rule.Action == ActionIgnore:
+		return provState, countryName, ActionIgnore
+	case rule.Action == ActionUnit:
+		return "", rule.Unit, ActionUnit
+	default:
+		return rule.rewrite(rule.Province, value, submatches, provState),
+			rule.rewrite(rule.Country, value, submatches, countryName),
+			""
+	}
+}
+
+// Normalize returns the name of the unit as the country name for unit rules.
+func (rules *NormalizationRules) Normalize(provState string, countryName string) (string, string, string) {
+	for _, rule := range rules.Rules {
+		var action string
+		if provState, countryName, action = rule.apply(provState, countryName); action != "" {
+			return provState, countryName, action
+		}
+	}
+	return provState, countryName, ""
+}
+
+func ReloadNormalizationRequest(res http.ResponseWriter, req *http.Request) {
+	if err := LoadNormalizationRules(); err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(res, req, "/import/status", http.StatusSeeOther)
+}
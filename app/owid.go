@@ -0,0 +1,250 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2020 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package app
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"github.com/JanDeVisser/grumble"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	owidISOCode               = "iso_code"
+	owidDate                  = "date"
+	owidTotalCases            = "total_cases"
+	owidTotalDeaths           = "total_deaths"
+	owidTotalTests            = "total_tests"
+	owidHospPatients          = "hosp_patients"
+	owidICUPatients           = "icu_patients"
+	owidTotalVaccinations     = "total_vaccinations"
+	owidPeopleVaccinated      = "people_vaccinated"
+	owidPeopleFullyVaccinated = "people_fully_vaccinated"
+	owidPositiveRate          = "positive_rate"
+)
+
+var owidRequiredColumns = []string{owidISOCode, owidDate}
+
+var owidColumns = []string{
+	owidISOCode, owidDate, owidTotalCases, owidTotalDeaths, owidTotalTests, owidHospPatients, owidICUPatients,
+	owidTotalVaccinations, owidPeopleVaccinated, owidPeopleFullyVaccinated, owidPositiveRate,
+}
+
+type owidRow struct {
+	Line   int
+	ISO    string
+	Values map[string]string
+}
+
+func readOWID(fileName string) (days map[string][]*owidRow, err error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	return parseOWID(f)
+}
+
+func parseOWID(in io.Reader) (days map[string][]*owidRow, err error) {
+	r := csv.NewReader(in)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return
+	}
+	indexes := make(map[string]int)
+	for ix, h := range header {
+		indexes[strings.TrimSpace(strings.TrimPrefix(h, "\ufeff"))] = ix
+	}
+	columns := make(map[string]int)
+	for _, column := range owidColumns {
+		if ix, ok := indexes[column]; ok {
+			columns[column] = ix
+		}
+	}
+	for _, column := range owidRequiredColumns {
+		if _, ok := columns[column]; !ok {
+			err = &MissingColumnError{Column: column, Header: header}
+			return
+		}
+	}
+	days = make(map[string][]*owidRow)
+	for {
+		var row []string
+		if row, err = r.Read(); err == io.EOF {
+			return days, nil
+		} else if err != nil {
+			return
+		}
+		line, _ := r.FieldPos(0)
+		rec := &owidRow{Line: line, Values: make(map[string]string, len(columns))}
+		for column, ix := range columns {
+			if ix < len(row) {
+				rec.Values[column] = strings.TrimSpace(row[ix])
+			}
+		}
+		rec.ISO = rec.Values[owidISOCode]
+		// Aggregates like World, continents and income groups
+		if rec.ISO == "" || strings.HasPrefix(rec.ISO, "OWID_") {
+			continue
+		}
+		d := rec.Values[owidDate]
+		days[d] = append(days[d], rec)
+	}
+}
+
+var owidMetrics = map[string]string{
+	owidTotalTests:            "tests",
+	owidHospPatients:          "hospitalized",
+	owidICUPatients:           "icu",
+	owidTotalVaccinations:     "vaccinations",
+	owidPeopleVaccinated:      "vaccinated",
+	owidPeopleFullyVaccinated: "fullyvaccinated",
+}
+
+// apply only takes confirmed cases and deaths for samples JHU didn't report.
+func (row *owidRow) apply(s *Sample, reported bool) (err error) {
+	for column, field := range map[string]*int{
+		owidTotalCases:  &s.Confirmed,
+		owidTotalDeaths: &s.Deceased,
+	} {
+		value := row.Values[column]
+		if value == "" || reported {
+			continue
+		}
+		if *field, err = parseCount(value); err != nil {
+			return fmt.Errorf("line %d: column %s: invalid number %q: %v", row.Line, column, value, err)
+		}
+	}
+	for column, name := range owidMetrics {
+		value := row.Values[column]
+		if value == "" {
+			continue
+		}
+		var i int
+		if i, err = parseCount(value); err != nil {
+			return fmt.Errorf("line %d: column %s: invalid number %q: %v", row.Line, column, value, err)
+		}
+		GetMetric(name).Set(s, i)
+	}
+	if value := row.Values[owidPositiveRate]; value != "" {
+		var f float64
+		if f, err = parseNumber(value); err != nil {
+			return fmt.Errorf("line %d: column %s: invalid number %q: %v", row.Line, owidPositiveRate, value, err)
+		}
+		s.SetPositivityRate(f)
+	}
+	return
+}
+
+func importOWIDDate(mgr *grumble.EntityManager, d time.Time, rows []*owidRow) (good int, errorCount int, err error) {
+	existing := make(map[int]*Sample)
+	q := mgr.MakeQuery(Sample{})
+	q.AddFilter("Date", d)
+	q.AddCondition(&grumble.IsRoot{})
+	results, err := q.Execute()
+	if err != nil {
+		return
+	}
+	for _, row := range results {
+		s := row[0].(*Sample)
+		if s.Jurisdiction != nil {
+			existing[s.Jurisdiction.Id()] = s
+		}
+	}
+	err = mgr.TX(func(db *sql.DB) (err error) {
+		for _, row := range rows {
+			j := GetJurisdiction(row.ISO)
+			if j == nil {
+				log.Printf("OWID %s: country for %q not found", d.Format("2006-01-02"), row.ISO)
+				errorCount++
+				continue
+			}
+			s, ok := existing[j.Id()]
+			if !ok {
+				var e grumble.Persistable
+				if e, err = mgr.New(Sample{}, grumble.ZeroKey); err != nil {
+					return
+				}
+				s = e.(*Sample)
+				s.Jurisdiction = j
+				s.Date = d
+			}
+			if e := row.apply(s, ok); e != nil {
+				log.Printf("OWID %s: %v", d.Format("2006-01-02"), e)
+				errorCount++
+				continue
+			}
+			if err = mgr.Put(s); err != nil {
+				return
+			}
+			good++
+		}
+		return
+	})
+	return
+}
+
+// ImportOWID imports the metrics from a local copy of the Our World in Data
+// owid-covid-data.csv file.
+func ImportOWID(mgr *grumble.EntityManager, fileName string, from *time.Time, to *time.Time, progress ImportProgress) (err error) {
+	days, err := readOWID(fileName)
+	if err != nil {
+		return
+	}
+	dates := make([]time.Time, 0, len(days))
+	for dstr := range days {
+		var d time.Time
+		if d, err = time.ParseInLocation("2006-01-02", dstr, time.UTC); err != nil {
+			return fmt.Errorf("%s: invalid date %q: %v", fileName, dstr, err)
+		}
+		if (from != nil && d.Before(*from)) || (to != nil && !to.After(d)) {
+			continue
+		}
+		dates = append(dates, d)
+	}
+	sort.Slice(dates, func(i, j int) bool {
+		return dates[i].Before(dates[j])
+	})
+	for ix, d := range dates {
+		var good, errorCount int
+		if good, errorCount, err = importOWIDDate(mgr, d, days[d.Format("2006-01-02")]); err != nil {
+			return
+		}
+		// Created samples change the daily numbers of the day after too
+		for _, day := range []time.Time{d, d.AddDate(0, 0, 1)} {
+			if _, err = RecomputeDeltas(mgr, day); err != nil {
+				return
+			}
+		}
+		if progress != nil {
+			progress(d, ix+1, len(dates), good, errorCount)
+		}
+	}
+	return
+}
@@ -0,0 +1,50 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2020 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package app
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseOWIDLinesAndColumns(t *testing.T) {
+	data := "iso_code,continent,location,date,total_cases,total_deaths\n" +
+		"NLD,Europe,Netherlands,2020-04-01,10,1\n" +
+		"OWID_WRL,,World,2020-04-01,100,10\n" +
+		"BEL,Europe,Belgium,2020-04-01,many,3\n"
+	days, err := parseOWID(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := days["2020-04-01"]
+	if len(rows) != 2 {
+		t.Fatalf("%d rows, expected 2", len(rows))
+	}
+	if rows[0].ISO != "NLD" || rows[0].Line != 2 || rows[1].ISO != "BEL" || rows[1].Line != 4 {
+		t.Errorf("unexpected rows %v %v", rows[0], rows[1])
+	}
+	if _, ok := rows[0].Values["location"]; ok {
+		t.Errorf("unused column was read: %v", rows[0].Values)
+	}
+	var s Sample
+	if err = rows[1].apply(&s, false); err == nil || !strings.HasPrefix(err.Error(), "line 4:") {
+		t.Errorf("error for invalid number: %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2020 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package app
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type ParseError struct {
+	File   string
+	Line   int
+	Column int
+	Header string
+	Value  string
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s:%d: column %d (%s): invalid number %q: %v", e.File, e.Line, e.Column, e.Header, e.Value, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+var errNotANumber = errors.New("not a number")
+
+// Numbers using a comma as thousands separator, like 1,234,567 or -12,345.5
+var thousands = regexp.MustCompile(`^[-+]?\d{1,3}(,\d{3})+(\.\d*)?$`)
+
+// parseNumber returns zero for an empty value.
+func parseNumber(s string) (f float64, err error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0.0, nil
+	}
+	if thousands.MatchString(s) {
+		s = strings.ReplaceAll(s, ",", "")
+	}
+	if f, err = strconv.ParseFloat(s, 64); err != nil {
+		var numErr *strconv.NumError
+		if errors.As(err, &numErr) {
+			err = numErr.Err
+		}
+		return
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0.0, errNotANumber
+	}
+	return
+}
+
+func parseCount(s string) (i int, err error) {
+	f, err := parseNumber(s)
+	if err != nil {
+		return
+	}
+	if math.Abs(f) > math.MaxInt32 {
+		return 0, strconv.ErrRange
+	}
+	return int(math.Round(f)), nil
+}
@@ -0,0 +1,385 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2020 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package app
+
+import (
+	"database/sql"
+	"github.com/JanDeVisser/grumble"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// jurisdictionIndex indexes jurisdictions by id and FIPS code, and by name, ISO
+// codes and aliases within their parent. The first jurisdiction to take a key
+// keeps it.
+type jurisdictionIndex struct {
+	byId       map[int]*Jurisdiction
+	byFIPS     map[string]*Jurisdiction
+	children   map[int]map[string]*Jurisdiction
+	folded     map[int]map[string]*Jurisdiction
+	keys       map[int][]string
+	foldedKeys map[int][]string
+	fips       map[int]string
+}
+
+func makeJurisdictionIndex() *jurisdictionIndex {
+	return &jurisdictionIndex{
+		byId:       make(map[int]*Jurisdiction),
+		byFIPS:     make(map[string]*Jurisdiction),
+		children:   make(map[int]map[string]*Jurisdiction),
+		folded:     make(map[int]map[string]*Jurisdiction),
+		keys:       make(map[int][]string),
+		foldedKeys: make(map[int][]string),
+		fips:       make(map[int]string),
+	}
+}
+
+func parentId(j *Jurisdiction) int {
+	if j.Parent() == nil || j.Parent() == grumble.ZeroKey {
+		return 0
+	}
+	return j.Parent().Id()
+}
+
+func addKeys(m map[string]*Jurisdiction, j *Jurisdiction, keys []string) (owned []string) {
+	owned = make([]string, 0, len(keys))
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if _, taken := m[key]; !taken {
+			m[key] = j
+			owned = append(owned, key)
+		}
+	}
+	return
+}
+
+func removeKeys(m map[string]*Jurisdiction, j *Jurisdiction, keys []string) {
+	for _, key := range keys {
+		if m[key] == j {
+			delete(m, key)
+		}
+	}
+}
+
+func childMap(maps map[int]map[string]*Jurisdiction, pid int) (m map[string]*Jurisdiction) {
+	m, ok := maps[pid]
+	if !ok {
+		m = make(map[string]*Jurisdiction)
+		maps[pid] = m
+	}
+	return
+}
+
+func (ix *jurisdictionIndex) add(j *Jurisdiction) {
+	ix.remove(j.Id())
+	ix.byId[j.Id()] = j
+	if j.FIPS != "" {
+		ix.byFIPS[j.FIPS] = j
+		ix.fips[j.Id()] = j.FIPS
+	}
+	pid := parentId(j)
+	keys := []string{j.Name, strconv.Itoa(j.Id()), j.Alpha2, j.Alpha3}
+	keys = append(keys, j.Aliases...)
+	ix.keys[j.Id()] = addKeys(childMap(ix.children, pid), j, keys)
+	variants := make([]string, 0, len(keys))
+	for _, key := range keys {
+		variants = append(variants, nameVariants(key)...)
+	}
+	ix.foldedKeys[j.Id()] = addKeys(childMap(ix.folded, pid), j, variants)
+}
+
+// remove uses the keys the jurisdiction was added under, since it may have
+// been changed in place since.
+func (ix *jurisdictionIndex) remove(id int) {
+	j, ok := ix.byId[id]
+	if !ok {
+		return
+	}
+	removeKeys(ix.children[parentId(j)], j, ix.keys[id])
+	removeKeys(ix.folded[parentId(j)], j, ix.foldedKeys[id])
+	if fips, ok := ix.fips[id]; ok && ix.byFIPS[fips] == j {
+		delete(ix.byFIPS, fips)
+	}
+	delete(ix.keys, id)
+	delete(ix.foldedKeys, id)
+	delete(ix.fips, id)
+	delete(ix.byId, id)
+}
+
+func (ix *jurisdictionIndex) resolve(pid int, name string) *Jurisdiction {
+	if j, ok := ix.children[pid][name]; ok {
+		return j
+	}
+	for _, variant := range nameVariants(name) {
+		if j, ok := ix.folded[pid][variant]; ok {
+			return j
+		}
+	}
+	return nil
+}
+
+func (ix *jurisdictionIndex) get(name string) *Jurisdiction {
+	if id, err := strconv.Atoi(name); err == nil {
+		return ix.byId[id]
+	}
+	return ix.resolve(0, name)
+}
+
+// JurisdictionRegistry caches all jurisdictions. It hands out the
+// jurisdictions it holds, so copy a jurisdiction before changing it.
+type JurisdictionRegistry struct {
+	lock  sync.RWMutex
+	index *jurisdictionIndex
+}
+
+type registryChange struct {
+	jurisdiction *Jurisdiction
+	deleted      bool
+}
+
+// RegistryTX collects the jurisdiction changes of a transaction, to apply them
+// to the registry once it commits.
+type RegistryTX struct {
+	Manager *grumble.EntityManager
+	changes []registryChange
+}
+
+func (tx *RegistryTX) Put(j *Jurisdiction) (err error) {
+	j.tx = tx
+	err = tx.Manager.Put(j)
+	j.tx = nil
+	if err == nil {
+		tx.record(j, false)
+	}
+	return
+}
+
+func (tx *RegistryTX) Delete(j *Jurisdiction) (err error) {
+	j.tx = tx
+	err = tx.Manager.Delete(j)
+	j.tx = nil
+	if err == nil {
+		tx.record(j, true)
+	}
+	return
+}
+
+func (tx *RegistryTX) record(j *Jurisdiction, deleted bool) {
+	tx.changes = append(tx.changes, registryChange{jurisdiction: j.Copy(), deleted: deleted})
+}
+
+func MakeJurisdictionRegistry() *JurisdictionRegistry {
+	return &JurisdictionRegistry{index: makeJurisdictionIndex()}
+}
+
+var Registry = MakeJurisdictionRegistry()
+
+func (r *JurisdictionRegistry) Reload(mgr *grumble.EntityManager) (err error) {
+	q := mgr.MakeQuery(Jurisdiction{})
+	results, err := q.Execute()
+	if err != nil {
+		return
+	}
+	index := makeJurisdictionIndex()
+	for _, row := range results {
+		index.add(row[0].(*Jurisdiction))
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.index = index
+	return
+}
+
+func (r *JurisdictionRegistry) Clear() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.index = makeJurisdictionIndex()
+}
+
+func (r *JurisdictionRegistry) Update(j *Jurisdiction) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.index.add(j.Copy())
+}
+
+func (r *JurisdictionRegistry) Remove(j *Jurisdiction) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.index.remove(j.Id())
+}
+
+func (r *JurisdictionRegistry) TX(mgr *grumble.EntityManager, fnc func(tx *RegistryTX) error) (err error) {
+	tx := &RegistryTX{Manager: mgr}
+	if err = mgr.TX(func(db *sql.DB) error {
+		return fnc(tx)
+	}); err != nil {
+		return
+	}
+	r.apply(tx.changes)
+	return
+}
+
+func (r *JurisdictionRegistry) apply(changes []registryChange) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, change := range changes {
+		if change.deleted {
+			r.index.remove(change.jurisdiction.Id())
+		} else {
+			r.index.add(change.jurisdiction)
+		}
+	}
+}
+
+func (r *JurisdictionRegistry) ById(id int) *Jurisdiction {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.index.byId[id]
+}
+
+func (r *JurisdictionRegistry) ByName(name string) *Jurisdiction {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.index.children[0][name]
+}
+
+func (r *JurisdictionRegistry) ByFIPS(fips string) *Jurisdiction {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.index.byFIPS[fips]
+}
+
+func (r *JurisdictionRegistry) Region(parent *Jurisdiction, name string) *Jurisdiction {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.index.children[parent.Id()][name]
+}
+
+// Resolve matches names ignoring case, diacritics and punctuation, and "Korea,
+// South" matches "South Korea".
+func (r *JurisdictionRegistry) Resolve(parent *Jurisdiction, name string) *Jurisdiction {
+	pid := 0
+	if parent != nil {
+		pid = parent.Id()
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.index.resolve(pid, name)
+}
+
+func (r *JurisdictionRegistry) Suggest(parent *Jurisdiction, name string, max int) (suggestions []*Jurisdiction) {
+	pid := 0
+	if parent != nil {
+		pid = parent.Id()
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	distances := make(map[int]int)
+	byId := make(map[int]*Jurisdiction)
+	for _, variant := range nameVariants(name) {
+		limit := maxSuggestionDistance(variant)
+		for key, j := range r.index.folded[pid] {
+			d := editDistance(variant, key)
+			if best, ok := distances[j.Id()]; d <= limit && (!ok || d < best) {
+				distances[j.Id()] = d
+				byId[j.Id()] = j
+			}
+		}
+	}
+	suggestions = make([]*Jurisdiction, 0, len(byId))
+	for _, j := range byId {
+		suggestions = append(suggestions, j)
+	}
+	sort.Slice(suggestions, func(i, j int) bool {
+		di, dj := distances[suggestions[i].Id()], distances[suggestions[j].Id()]
+		if di != dj {
+			return di < dj
+		}
+		return suggestions[i].Name < suggestions[j].Name
+	})
+	if len(suggestions) > max {
+		suggestions = suggestions[:max]
+	}
+	return
+}
+
+// Lookup takes an id or a path like "US/New York/Kings".
+func (r *JurisdictionRegistry) Lookup(path string) *Jurisdiction {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if j := r.index.get(path); j != nil || !strings.Contains(path, "/") {
+		return j
+	}
+	segments := strings.Split(path, "/")
+	j := r.index.get(strings.TrimSpace(segments[0]))
+	for _, segment := range segments[1:] {
+		if j == nil {
+			break
+		}
+		j = r.index.resolve(j.Id(), strings.TrimSpace(segment))
+	}
+	return j
+}
+
+func (r *JurisdictionRegistry) Path(j *Jurisdiction) string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	names := []string{j.Name}
+	for pid := parentId(j); pid != 0; {
+		p, ok := r.index.byId[pid]
+		if !ok {
+			break
+		}
+		names = append([]string{p.Name}, names...)
+		pid = parentId(p)
+	}
+	return strings.Join(names, "/")
+}
+
+func (r *JurisdictionRegistry) Regions(parent *Jurisdiction) (regions []*Jurisdiction) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	regions = make([]*Jurisdiction, 0)
+	seen := make(map[int]bool)
+	for _, j := range r.index.children[parent.Id()] {
+		if !seen[j.Id()] {
+			seen[j.Id()] = true
+			regions = append(regions, j)
+		}
+	}
+	sort.Slice(regions, func(i, j int) bool {
+		return regions[i].Name < regions[j].Name
+	})
+	return
+}
+
+func (r *JurisdictionRegistry) All() (all []*Jurisdiction) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	all = make([]*Jurisdiction, 0, len(r.index.byId))
+	for _, j := range r.index.byId {
+		all = append(all, j)
+	}
+	return
+}
@@ -0,0 +1,114 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2020 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package app
+
+import (
+	"github.com/JanDeVisser/grumble"
+	"testing"
+)
+
+func testJurisdiction(id int, name string, aliases ...string) *Jurisdiction {
+	j := &Jurisdiction{Name: name, Aliases: aliases}
+	j.Key = grumble.Key{Ident: id}
+	return j
+}
+
+func TestRegistryHoldsCopies(t *testing.T) {
+	r := MakeJurisdictionRegistry()
+	j := testJurisdiction(1, "Netherlands", "Holland")
+	r.Update(j)
+	j.Name = "Changed"
+	j.Aliases[0] = "Changed"
+	if got := r.ByName("Netherlands"); got == nil || got.Name != "Netherlands" {
+		t.Fatalf("changing the stored jurisdiction changed the registry: %v", got)
+	}
+	if r.ByName("Holland") == nil {
+		t.Errorf("changing the aliases of the stored jurisdiction changed the registry")
+	}
+
+	c := r.ById(1).Copy()
+	c.Aliases = append(c.Aliases, "Nederland")
+	if r.ByName("Nederland") != nil || len(r.ById(1).Aliases) != 1 {
+		t.Errorf("changing a copy changed the registry")
+	}
+	r.Update(c)
+	if r.ByName("Nederland") == nil || r.ByName("Holland") == nil {
+		t.Errorf("updated jurisdiction not found by its aliases")
+	}
+}
+
+func TestRegistryTXChanges(t *testing.T) {
+	r := MakeJurisdictionRegistry()
+	r.Update(testJurisdiction(1, "Netherlands"))
+	tx := &RegistryTX{}
+	tx.record(testJurisdiction(2, "Belgium"), false)
+	tx.record(r.ById(1), true)
+	// A change made outside the transaction is applied right away
+	r.Update(testJurisdiction(3, "France"))
+	if r.ById(2) != nil || r.ById(1) == nil || r.ById(3) == nil {
+		t.Fatalf("changes made in a transaction were applied before it committed")
+	}
+	r.apply(tx.changes)
+	if r.ById(2) == nil || r.ById(1) != nil || r.ByName("Netherlands") != nil {
+		t.Errorf("changes of a committed transaction were not applied")
+	}
+	if r.ById(3) == nil {
+		t.Errorf("change made outside the transaction was lost")
+	}
+}
+
+func TestJurisdictionHooksSkipRegistryTX(t *testing.T) {
+	j := testJurisdiction(999, "Atlantis")
+	defer Registry.Remove(j)
+	j.tx = &RegistryTX{}
+	_ = j.AfterPut()
+	if Registry.ById(999) != nil {
+		t.Fatalf("jurisdiction stored through a RegistryTX was cached before it committed")
+	}
+	j.tx = nil
+	_ = j.AfterPut()
+	if Registry.ById(999) == nil {
+		t.Errorf("stored jurisdiction was not cached")
+	}
+	_ = j.AfterDelete()
+	if Registry.ById(999) != nil {
+		t.Errorf("deleted jurisdiction still cached")
+	}
+}
+
+func TestGetRegionFallsBackToExactUnitNames(t *testing.T) {
+	country := testJurisdiction(901, "Testland")
+	other := testJurisdiction(902, "Testonia")
+	unit := testJurisdiction(903, "Test Princess")
+	unit.NonGeographic = true
+	for _, j := range []*Jurisdiction{country, other, unit} {
+		Registry.Update(j)
+		defer Registry.Remove(j)
+	}
+	if got := country.GetRegion("Testonia"); got != nil {
+		t.Errorf("region Testonia resolved to country %v", got)
+	}
+	if got := country.GetRegion("Test Princess"); got == nil || got.Id() != 903 {
+		t.Errorf("region Test Princess resolved to %v, expected the unit", got)
+	}
+	if got := country.GetRegion("test-princess"); got != nil {
+		t.Errorf("region test-princess resolved to %v", got)
+	}
+}
@@ -0,0 +1,156 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2020 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package app
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+var foldedLetters = make(map[rune]string)
+
+func init() {
+	for plain, letters := range map[string]string{
+		"a":  "àáâãäåāăą",
+		"c":  "çćĉċč",
+		"d":  "ďđð",
+		"e":  "èéêëēĕėęě",
+		"g":  "ĝğġģ",
+		"h":  "ĥħ",
+		"i":  "ìíîïĩīĭįı",
+		"j":  "ĵ",
+		"k":  "ķ",
+		"l":  "ĺļľŀł",
+		"n":  "ñńņňŉ",
+		"o":  "òóôõöøōŏő",
+		"r":  "ŕŗř",
+		"s":  "śŝşšș",
+		"t":  "ţťŧț",
+		"u":  "ùúûüũūŭůűų",
+		"w":  "ŵ",
+		"y":  "ýÿŷ",
+		"z":  "źżž",
+		"ae": "æ",
+		"oe": "œ",
+		"ss": "ß",
+		"th": "þ",
+	} {
+		for _, r := range letters {
+			foldedLetters[r] = plain
+		}
+	}
+}
+
+// Words mapped to the empty string are dropped.
+var foldedWords = map[string]string{
+	"the": "",
+	"and": "",
+	"st":  "saint",
+	"ste": "sainte",
+}
+
+// foldName folds spelling variants of a name to the same string.
+func foldName(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case r == '\'' || r == '’' || r == '`':
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			b.WriteRune(r)
+		case foldedLetters[r] != "":
+			b.WriteString(foldedLetters[r])
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+		default:
+			b.WriteRune(' ')
+		}
+	}
+	words := make([]string, 0)
+	for _, word := range strings.Fields(b.String()) {
+		if folded, ok := foldedWords[word]; ok {
+			word = folded
+		}
+		if word != "" {
+			words = append(words, word)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// nameVariants also returns "Korea, South" as "South Korea".
+func nameVariants(name string) (variants []string) {
+	variants = make([]string, 0, 2)
+	if folded := foldName(name); folded != "" {
+		variants = append(variants, folded)
+	}
+	if parts := strings.Split(name, ","); len(parts) == 2 {
+		if inverted := foldName(parts[1] + " " + parts[0]); inverted != "" && (len(variants) == 0 || inverted != variants[0]) {
+			variants = append(variants, inverted)
+		}
+	}
+	return
+}
+
+func editDistance(a string, b string) int {
+	s, t := []rune(a), []rune(b)
+	row := make([]int, len(t)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		diagonal := row[0]
+		row[0] = i
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			next := diagonal + cost
+			if row[j]+1 < next {
+				next = row[j] + 1
+			}
+			if row[j-1]+1 < next {
+				next = row[j-1] + 1
+			}
+			diagonal, row[j] = row[j], next
+		}
+	}
+	return row[len(t)]
+}
+
+// maxSuggestionDistance allows about one typo for every four letters.
+func maxSuggestionDistance(folded string) int {
+	if d := len([]rune(folded)) / 4; d > 1 {
+		return d
+	}
+	return 1
+}
+
+func describeSuggestions(suggestions []*Jurisdiction) string {
+	if len(suggestions) == 0 {
+		return ""
+	}
+	names := make([]string, len(suggestions))
+	for ix, j := range suggestions {
+		names[ix] = fmt.Sprintf("%q", j.Name)
+	}
+	return fmt.Sprintf("; did you mean %s?", strings.Join(names, " or "))
+}
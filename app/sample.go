@@ -20,25 +20,153 @@
 package app
 
 import (
+	"encoding/csv"
 	"fmt"
 	"github.com/JanDeVisser/grumble"
 	"github.com/JanDeVisser/grumble/handler"
+	"io"
 	"log"
 	"net/url"
+	"strconv"
 	"time"
 )
 
 type Sample struct {
 	grumble.Key
-	Jurisdiction *Jurisdiction
-	Date         time.Time
-	NewConfirmed int `grumble:"verbose_name=New Confirmed Cases;transient=true"`
-	Confirmed    int `grumble:"verbose_name=Total Confirmed Cases"`
-	NewDeceased  int `grumble:"verbose_name=Newly Deceased Cases;transient=true"`
-	Deceased     int `grumble:"verbose_name=Total Deceased Cases"`
-	Recovered    int
-	subs         map[string]*Sample
-	region       *Region
+	Jurisdiction        *Jurisdiction
+	Date                time.Time
+	NewConfirmed        int `grumble:"verbose_name=New Confirmed Cases"`
+	Confirmed           int `grumble:"verbose_name=Total Confirmed Cases"`
+	NewDeceased         int `grumble:"verbose_name=Newly Deceased Cases"`
+	Deceased            int `grumble:"verbose_name=Total Deceased Cases"`
+	NewRecovered        int `grumble:"verbose_name=Newly Recovered Cases"`
+	Recovered           int
+	ConfirmedCorrection int     `grumble:"verbose_name=Confirmed Cases Correction"`
+	DeceasedCorrection  int     `grumble:"verbose_name=Deceased Cases Correction"`
+	RecoveredCorrection int     `grumble:"verbose_name=Recovered Cases Correction"`
+	UnassignedConfirmed int     `grumble:"verbose_name=Unassigned Confirmed Cases"`
+	UnassignedDeceased  int     `grumble:"verbose_name=Unassigned Deceased Cases"`
+	TotalTests          int     `grumble:"verbose_name=Total Tests"`
+	PositivityRate      float64 `grumble:"verbose_name=Positivity Rate"`
+	Hospitalized        int     `grumble:"verbose_name=Hospitalized Patients"`
+	ICUPatients         int     `grumble:"verbose_name=ICU Patients"`
+	Vaccinations        int     `grumble:"verbose_name=Total Vaccinations"`
+	Vaccinated          int     `grumble:"verbose_name=People Vaccinated"`
+	FullyVaccinated     int     `grumble:"verbose_name=People Fully Vaccinated"`
+	Reported            int     `grumble:"verbose_name=Reported Metrics"`
+	subs                map[string]*Sample
+	region              *Region
+	rows                int
+	metricRows          map[int]int
+	filled              bool
+}
+
+// unassigned adds rows counted in this sample but in none of its subdivisions,
+// like "Unassigned" or "Out of <state>".
+func (sample *Sample) unassigned(rec *SampleRecord) {
+	sample.UnassignedConfirmed += rec.Confirmed
+	sample.UnassignedDeceased += rec.Deceased
+}
+
+func (sample *Sample) Active() int {
+	return sample.Confirmed - sample.Deceased - sample.Recovered
+}
+
+// Flags in Sample.Reported telling an unreported metric from a zero one.
+const (
+	ReportedTests = 1 << iota
+	ReportedPositivityRate
+	ReportedHospitalized
+	ReportedICUPatients
+	ReportedVaccinations
+	ReportedVaccinated
+	ReportedFullyVaccinated
+)
+
+type Metric struct {
+	Name  string
+	Label string
+	Flag  int
+	field func(s *Sample) *int
+}
+
+var Metrics = []*Metric{
+	{Name: "tests", Label: "Tests", Flag: ReportedTests, field: func(s *Sample) *int { return &s.TotalTests }},
+	{Name: "hospitalized", Label: "Hospitalized", Flag: ReportedHospitalized, field: func(s *Sample) *int { return &s.Hospitalized }},
+	{Name: "icu", Label: "ICU Patients", Flag: ReportedICUPatients, field: func(s *Sample) *int { return &s.ICUPatients }},
+	{Name: "vaccinations", Label: "Vaccinations", Flag: ReportedVaccinations, field: func(s *Sample) *int { return &s.Vaccinations }},
+	{Name: "vaccinated", Label: "Vaccinated", Flag: ReportedVaccinated, field: func(s *Sample) *int { return &s.Vaccinated }},
+	{Name: "fullyvaccinated", Label: "Fully Vaccinated", Flag: ReportedFullyVaccinated, field: func(s *Sample) *int { return &s.FullyVaccinated }},
+}
+
+func GetMetric(name string) *Metric {
+	for _, metric := range Metrics {
+		if metric.Name == name {
+			return metric
+		}
+	}
+	return nil
+}
+
+func (metric *Metric) Value(s *Sample) (value int, reported bool) {
+	return *metric.field(s), s.HasMetric(metric.Flag)
+}
+
+func (metric *Metric) Set(s *Sample, value int) {
+	*metric.field(s) = value
+	s.Reported |= metric.Flag
+}
+
+func (metric *Metric) Add(s *Sample, value int) {
+	*metric.field(s) += value
+	s.Reported |= metric.Flag
+}
+
+func (sample *Sample) HasMetric(flag int) bool {
+	return sample.Reported&flag != 0
+}
+
+func (sample *Sample) SetPositivityRate(rate float64) {
+	sample.PositivityRate = rate
+	sample.Reported |= ReportedPositivityRate
+}
+
+func (sample *Sample) addMetrics(rec *SampleRecord) {
+	sample.rows++
+	for _, metric := range Metrics {
+		if value, ok := rec.Metrics[metric.Name]; ok {
+			metric.Add(sample, value)
+			if sample.metricRows == nil {
+				sample.metricRows = make(map[int]int)
+			}
+			sample.metricRows[metric.Flag]++
+		}
+	}
+}
+
+// dropPartialMetrics clears the metrics only some rows of the sample reported,
+// since their total would cover only part of the jurisdiction.
+func (sample *Sample) dropPartialMetrics() {
+	for _, metric := range Metrics {
+		if n := sample.metricRows[metric.Flag]; n > 0 && n < sample.rows {
+			*metric.field(sample) = 0
+			sample.Reported &^= metric.Flag
+		}
+	}
+	for _, sub := range sample.subs {
+		sub.dropPartialMetrics()
+	}
+}
+
+func (sample *Sample) copyMetrics(other *Sample) {
+	for _, metric := range Metrics {
+		if value, ok := metric.Value(other); ok && !sample.HasMetric(metric.Flag) {
+			metric.Set(sample, value)
+		}
+	}
+	if other.HasMetric(ReportedPositivityRate) && !sample.HasMetric(ReportedPositivityRate) {
+		sample.SetPositivityRate(other.PositivityRate)
+	}
 }
 
 func OldestAndNewestSample(mgr *grumble.EntityManager) (oldest time.Time, newest time.Time, err error) {
@@ -101,6 +229,13 @@ func (sample *Sample) ManyQuery(query *grumble.Query, values url.Values) (ret *g
 		}
 	}
 	ret.AddCondition(&grumble.IsRoot{})
+	if units := NonGeographicUnits(); values.Get("units") == "false" && len(units) > 0 {
+		ret.AddCondition(&grumble.References{
+			Column:     "Jurisdiction",
+			References: units,
+			Invert:     true,
+		})
+	}
 	ret.AddFilter("Date", d)
 	ret.AddSort(grumble.Sort{Column: "Confirmed", Direction: "DESC"})
 	return
@@ -128,7 +263,14 @@ func (sample *Sample) MakeListContext(req *handler.EntityRequest, data map[strin
 	data["Exclude"] = req.Values.Get("exclude")
 	data["Cases"] = req.Values.Get("cases")
 	data["Deaths"] = req.Values.Get("deaths")
+	data["Recovered"] = seriesChartType(req.Values.Get("recovered"))
+	data["Active"] = seriesChartType(req.Values.Get("active"))
+	data["Gaps"] = req.Values.Get("gaps")
 	data["Regression"] = req.Values.Get("regression")
+	data["Units"] = req.Values.Get("units")
+	data["Metric"] = req.Values.Get("metric")
+	data["MetricType"] = req.Values.Get("metrictype")
+	data["metrics"] = Metrics
 	dates := make([]time.Time, 0)
 	for d := oldest; d.Before(newest); d = d.AddDate(0, 0, 1) {
 		dates = append(dates, d)
@@ -136,3 +278,67 @@ func (sample *Sample) MakeListContext(req *handler.EntityRequest, data map[strin
 	data["dates"] = append(dates, newest)
 	return
 }
+
+// ExportSamples writes the samples from up to but not including to as CSV.
+func ExportSamples(mgr *grumble.EntityManager, w io.Writer, from *time.Time, to *time.Time) (err error) {
+	q := mgr.MakeQuery(Sample{})
+	q.AddSort(grumble.Sort{Column: "Date", Direction: "ASC"})
+	q.AddReferenceJoins()
+	results, err := q.Execute()
+	if err != nil {
+		return
+	}
+	out := csv.NewWriter(w)
+	header := []string{"Date", "Country", "Region", "County", "Confirmed", "Deceased", "Recovered", "Active"}
+	for _, metric := range Metrics {
+		header = append(header, metric.Label)
+	}
+	if err = out.Write(append(header, "Positivity Rate")); err != nil {
+		return
+	}
+	for _, row := range results {
+		s := row[0].(*Sample)
+		if (from != nil && s.Date.Before(*from)) || (to != nil && !s.Date.Before(*to)) {
+			continue
+		}
+		names := make([]string, 0, 3)
+		for j := row[1].(*Jurisdiction); j != nil; {
+			names = append([]string{j.Name}, names...)
+			if j.Parent() == nil || j.Parent() == grumble.ZeroKey {
+				break
+			}
+			j = Registry.ById(j.Parent().Id())
+		}
+		for len(names) < 3 {
+			names = append(names, "")
+		}
+		record := []string{
+			s.Date.Format("2006-01-02"),
+			names[0],
+			names[1],
+			names[2],
+			strconv.Itoa(s.Confirmed),
+			strconv.Itoa(s.Deceased),
+			strconv.Itoa(s.Recovered),
+			strconv.Itoa(s.Active()),
+		}
+		// Metrics which weren't reported are left empty
+		for _, metric := range Metrics {
+			value, ok := metric.Value(s)
+			if !ok {
+				record = append(record, "")
+				continue
+			}
+			record = append(record, strconv.Itoa(value))
+		}
+		rate := ""
+		if s.HasMetric(ReportedPositivityRate) {
+			rate = strconv.FormatFloat(s.PositivityRate, 'f', -1, 64)
+		}
+		if err = out.Write(append(record, rate)); err != nil {
+			return
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
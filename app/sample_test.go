@@ -0,0 +1,59 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2020 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package app
+
+import (
+	"testing"
+)
+
+func TestDropPartialMetrics(t *testing.T) {
+	country := &Sample{subs: make(map[string]*Sample)}
+	complete := &Sample{}
+	partial := &Sample{}
+	country.subs["complete"] = complete
+	country.subs["partial"] = partial
+	for _, add := range []struct {
+		region  *Sample
+		metrics map[string]int
+	}{
+		{complete, map[string]int{"tests": 100, "hospitalized": 5}},
+		{complete, map[string]int{"tests": 50, "hospitalized": 3}},
+		{partial, map[string]int{"tests": 20}},
+		{partial, map[string]int{}},
+	} {
+		rec := &SampleRecord{Metrics: add.metrics}
+		country.addMetrics(rec)
+		add.region.addMetrics(rec)
+	}
+	country.dropPartialMetrics()
+
+	if value, ok := GetMetric("tests").Value(complete); !ok || value != 150 {
+		t.Errorf("tests of region reporting them on every row: %d, %v", value, ok)
+	}
+	if value, ok := GetMetric("tests").Value(partial); ok || value != 0 {
+		t.Errorf("tests of region reporting them on some rows: %d, %v", value, ok)
+	}
+	if value, ok := GetMetric("tests").Value(country); ok || value != 0 {
+		t.Errorf("tests of country with a region not reporting them: %d, %v", value, ok)
+	}
+	if _, ok := GetMetric("hospitalized").Value(country); ok {
+		t.Errorf("hospitalized of country reported by one region only")
+	}
+}
@@ -0,0 +1,134 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2020 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package app
+
+import (
+	"github.com/JanDeVisser/grumble"
+	"github.com/JanDeVisser/grumble/handler"
+	"net/url"
+	"time"
+)
+
+// SampleRevision records the change in the totals of a jurisdiction when a
+// report was revised upstream.
+type SampleRevision struct {
+	grumble.Key
+	Jurisdiction *Jurisdiction
+	Date         time.Time
+	File         string
+	Timestamp    time.Time
+	OldConfirmed int `grumble:"verbose_name=Old Confirmed"`
+	NewConfirmed int `grumble:"verbose_name=New Confirmed"`
+	OldDeceased  int `grumble:"verbose_name=Old Deceased"`
+	NewDeceased  int `grumble:"verbose_name=New Deceased"`
+	OldRecovered int `grumble:"verbose_name=Old Recovered"`
+	NewRecovered int `grumble:"verbose_name=New Recovered"`
+}
+
+type sampleTotals struct {
+	Jurisdiction *Jurisdiction
+	Confirmed    int
+	Deceased     int
+	Recovered    int
+}
+
+func storedTotals(mgr *grumble.EntityManager, d time.Time) (totals map[int]*sampleTotals, err error) {
+	totals = make(map[int]*sampleTotals)
+	q := mgr.MakeQuery(Sample{})
+	q.AddFilter("Date", d)
+	q.AddReferenceJoins()
+	results, err := q.Execute()
+	if err != nil {
+		return
+	}
+	for _, row := range results {
+		s := row[0].(*Sample)
+		j := row[1].(*Jurisdiction)
+		totals[j.Id()] = &sampleTotals{Jurisdiction: j, Confirmed: s.Confirmed, Deceased: s.Deceased, Recovered: s.Recovered}
+	}
+	return
+}
+
+func importedTotals(samples map[string]*Sample, totals map[int]*sampleTotals) map[int]*sampleTotals {
+	if totals == nil {
+		totals = make(map[int]*sampleTotals)
+	}
+	for _, s := range samples {
+		totals[s.Jurisdiction.Id()] = &sampleTotals{Jurisdiction: s.Jurisdiction, Confirmed: s.Confirmed, Deceased: s.Deceased, Recovered: s.Recovered}
+		importedTotals(s.subs, totals)
+	}
+	return totals
+}
+
+func writeSampleRevisions(mgr *grumble.EntityManager, d time.Time, fname string, old map[int]*sampleTotals, revised map[int]*sampleTotals) (count int, err error) {
+	ids := make(map[int]*Jurisdiction)
+	for id, t := range old {
+		ids[id] = t.Jurisdiction
+	}
+	for id, t := range revised {
+		ids[id] = t.Jurisdiction
+	}
+	now := time.Now()
+	for id, j := range ids {
+		o, n := old[id], revised[id]
+		if o == nil {
+			o = &sampleTotals{}
+		}
+		if n == nil {
+			n = &sampleTotals{}
+		}
+		if o.Confirmed == n.Confirmed && o.Deceased == n.Deceased && o.Recovered == n.Recovered {
+			continue
+		}
+		var e grumble.Persistable
+		if e, err = mgr.New(SampleRevision{}, grumble.ZeroKey); err != nil {
+			return
+		}
+		rev := e.(*SampleRevision)
+		rev.Jurisdiction = j
+		rev.Date = d
+		rev.File = fname
+		rev.Timestamp = now
+		rev.OldConfirmed, rev.NewConfirmed = o.Confirmed, n.Confirmed
+		rev.OldDeceased, rev.NewDeceased = o.Deceased, n.Deceased
+		rev.OldRecovered, rev.NewRecovered = o.Recovered, n.Recovered
+		if err = mgr.Put(rev); err != nil {
+			return
+		}
+		count++
+	}
+	return
+}
+
+func (rev *SampleRevision) ManyQuery(query *grumble.Query, values url.Values) (ret *grumble.Query) {
+	ret = query
+	if file := values.Get("file"); file != "" {
+		ret.AddFilter("File", file)
+	}
+	ret.AddSort(grumble.Sort{Column: "Timestamp", Direction: "DESC"})
+	ret.AddSort(grumble.Sort{Column: "Date", Direction: "DESC"})
+	ret.AddReferenceJoins()
+	return
+}
+
+func (rev *SampleRevision) MakeListContext(req *handler.EntityRequest, data map[string]interface{}) (err error) {
+	data["File"] = req.Values.Get("file")
+	return
+}
@@ -0,0 +1,185 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2020 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/JanDeVisser/grumble/handler"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SampleSource is a feed of daily reports.
+type SampleSource interface {
+	Name() string
+	Dates(from time.Time, to time.Time) ([]time.Time, error)
+	Fetch(ctx context.Context, d time.Time) ([]byte, error)
+	Parse(d time.Time, data []byte) ([]*SampleRecord, error)
+}
+
+// CachingSource is a SampleSource keeping local copies of its reports.
+type CachingSource interface {
+	Invalidate(d time.Time)
+}
+
+// SampleRecord is a row of a report. Err is set if a value in the row could
+// not be parsed.
+type SampleRecord struct {
+	Line              int
+	FIPS              string
+	Admin2            string
+	ProvState         string
+	CountryName       string
+	Confirmed         int
+	Deceased          int
+	Recovered         int
+	Active            int
+	IncidentRate      float64
+	CaseFatalityRatio float64
+	Metrics           map[string]int
+	Raw               []string
+	Err               error
+}
+
+var sampleSources = make(map[string]func() SampleSource)
+
+func RegisterSampleSource(name string, factory func() SampleSource) {
+	sampleSources[name] = factory
+}
+
+func GetSampleSource(name string) (source SampleSource, err error) {
+	if name == "" {
+		name = "jhu"
+		if importDir() != "" {
+			name = "dir"
+		}
+	}
+	factory, ok := sampleSources[name]
+	if !ok {
+		err = fmt.Errorf("unknown sample source %q", name)
+		return
+	}
+	return factory(), nil
+}
+
+func SampleSources() (names []string) {
+	names = make([]string, 0)
+	for name := range sampleSources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+/* ================================================================================================================ */
+
+const jhuDailyReports = "csse_covid_19_data/csse_covid_19_daily_reports"
+
+// DirectorySource reads MM-DD-YYYY.csv daily reports from a directory or from
+// a checkout of the JHU repository.
+type DirectorySource struct {
+	Dir string
+}
+
+func importDir() string {
+	if dirIface, ok := handler.GetAppConfig()["importdir"]; ok {
+		return dirIface.(string)
+	}
+	return ""
+}
+
+// requestImportDir only allows web requests to import from root, the importdir
+// app config value, and the directories below it.
+func requestImportDir(root string, dir string) (string, error) {
+	if root == "" {
+		return "", errors.New("importing from a directory is not enabled")
+	}
+	root = filepath.Clean(root)
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(root, dir)
+	}
+	dir = filepath.Clean(dir)
+	if rel, err := filepath.Rel(root, dir); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("directory %q is outside the import directory", dir)
+	}
+	return dir, nil
+}
+
+func MakeDirectorySource(dir string) *DirectorySource {
+	if fi, err := os.Stat(filepath.Join(dir, jhuDailyReports)); err == nil && fi.IsDir() {
+		dir = filepath.Join(dir, jhuDailyReports)
+	}
+	return &DirectorySource{Dir: dir}
+}
+
+func init() {
+	RegisterSampleSource("dir", func() SampleSource {
+		return MakeDirectorySource(importDir())
+	})
+}
+
+func (dir *DirectorySource) Name() string {
+	return "dir"
+}
+
+func (dir *DirectorySource) Dates(from time.Time, to time.Time) (dates []time.Time, err error) {
+	if dir.Dir == "" {
+		err = fmt.Errorf("no import directory configured")
+		return
+	}
+	files, err := ioutil.ReadDir(dir.Dir)
+	if err != nil {
+		return
+	}
+	dates = make([]time.Time, 0)
+	for _, fi := range files {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), ".csv") {
+			continue
+		}
+		d, err := time.ParseInLocation("01-02-2006", strings.TrimSuffix(fi.Name(), ".csv"), time.UTC)
+		if err != nil {
+			continue
+		}
+		if !d.Before(from) && to.After(d) {
+			dates = append(dates, d)
+		}
+	}
+	sort.Slice(dates, func(i, j int) bool {
+		return dates[i].Before(dates[j])
+	})
+	return
+}
+
+func (dir *DirectorySource) Fetch(ctx context.Context, d time.Time) (data []byte, err error) {
+	fname := filepath.Join(dir.Dir, fmt.Sprintf("%s.csv", reportName(d)))
+	log.Printf("Reading %s", fname)
+	return ioutil.ReadFile(fname)
+}
+
+func (dir *DirectorySource) Parse(d time.Time, data []byte) (records []*SampleRecord, err error) {
+	return parseJHUReport(reportName(d)+".csv", data)
+}
@@ -0,0 +1,51 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2020 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package app
+
+import (
+	"testing"
+)
+
+func TestRequestImportDir(t *testing.T) {
+	for _, tc := range []struct {
+		root string
+		dir  string
+		ok   bool
+		want string
+	}{
+		{"/data/jhu", "/data/jhu", true, "/data/jhu"},
+		{"/data/jhu", "/data/jhu/daily/", true, "/data/jhu/daily"},
+		{"/data/jhu/", "daily", true, "/data/jhu/daily"},
+		{"/data/jhu", "..", false, ""},
+		{"/data/jhu", "daily/../../etc", false, ""},
+		{"/data/jhu", "/data/jhu/../jhu2", false, ""},
+		{"/data/jhu", "/etc", false, ""},
+		{"/data/jhu", "..data", true, "/data/jhu/..data"},
+		{"", "/data/jhu", false, ""},
+	} {
+		dir, err := requestImportDir(tc.root, tc.dir)
+		if tc.ok && (err != nil || dir != tc.want) {
+			t.Errorf("requestImportDir(%q, %q) = %q, %v, expected %q", tc.root, tc.dir, dir, err, tc.want)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("requestImportDir(%q, %q) = %q, expected an error", tc.root, tc.dir, dir)
+		}
+	}
+}
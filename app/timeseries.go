@@ -0,0 +1,250 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2020 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const JHUTimeSeriesURL = "https://raw.github.com/CSSEGISandData/COVID-19/master/csse_covid_19_data/csse_covid_19_time_series"
+
+// TimeSeriesSource imports the JHU time series files, which have a column per
+// date. Fetch returns a date in the daily report layout.
+type TimeSeriesSource struct {
+	BaseURL    string
+	US         bool
+	Downloader *Downloader
+	lock       sync.Mutex
+	tables     []*timeSeriesTable
+	dates      []time.Time
+}
+
+type timeSeriesRow struct {
+	FIPS        string
+	Admin2      string
+	ProvState   string
+	CountryName string
+	Values      map[string]string
+}
+
+type timeSeriesFile struct {
+	Name   string
+	Field  string
+	Global bool
+}
+
+var timeSeriesFiles = []timeSeriesFile{
+	{Name: "time_series_covid19_confirmed_global.csv", Field: jhuConfirmed, Global: true},
+	{Name: "time_series_covid19_deaths_global.csv", Field: jhuDeaths, Global: true},
+	{Name: "time_series_covid19_recovered_global.csv", Field: jhuRecovered, Global: true},
+	{Name: "time_series_covid19_confirmed_US.csv", Field: jhuConfirmed},
+	{Name: "time_series_covid19_deaths_US.csv", Field: jhuDeaths},
+}
+
+type timeSeriesTable struct {
+	File    timeSeriesFile
+	Rows    [][]string
+	Columns jhuColumnMap
+	Dates   map[string]int
+}
+
+func MakeTimeSeriesSource() SampleSource {
+	return &TimeSeriesSource{BaseURL: JHUTimeSeriesURL, US: true, Downloader: MakeDownloader()}
+}
+
+func init() {
+	RegisterSampleSource("timeseries", MakeTimeSeriesSource)
+}
+
+func (ts *TimeSeriesSource) Name() string {
+	return "timeseries"
+}
+
+func (ts *TimeSeriesSource) load(ctx context.Context) (err error) {
+	tables := make([]*timeSeriesTable, 0, len(timeSeriesFiles))
+	seen := make(map[string]time.Time)
+	for _, file := range timeSeriesFiles {
+		if !file.Global && !ts.US {
+			continue
+		}
+		var data []byte
+		if data, err = ts.Downloader.Get(ctx, fmt.Sprintf("%s/%s", ts.BaseURL, file.Name)); err != nil {
+			return
+		}
+		var table *timeSeriesTable
+		if table, err = makeTimeSeriesTable(file, data, seen); err != nil {
+			return fmt.Errorf("%s: %v", file.Name, err)
+		}
+		tables = append(tables, table)
+	}
+	ts.tables = tables
+	ts.dates = make([]time.Time, 0, len(seen))
+	for _, d := range seen {
+		ts.dates = append(ts.dates, d)
+	}
+	sort.Slice(ts.dates, func(i, j int) bool {
+		return ts.dates[i].Before(ts.dates[j])
+	})
+	return
+}
+
+func makeTimeSeriesTable(file timeSeriesFile, data []byte, dates map[string]time.Time) (table *timeSeriesTable, err error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	rows, err := r.ReadAll()
+	if err != nil {
+		return
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("empty time series")
+	}
+	header := rows[0]
+	table = &timeSeriesTable{
+		File:    file,
+		Rows:    rows[1:],
+		Columns: make(jhuColumnMap),
+		Dates:   make(map[string]int),
+	}
+	for ix, h := range header {
+		h = strings.TrimSpace(strings.TrimPrefix(h, "\ufeff"))
+		if d, err := time.ParseInLocation("1/2/06", h, time.UTC); err == nil {
+			table.Dates[reportName(d)] = ix
+			dates[reportName(d)] = d
+		} else if field, ok := jhuHeaders[h]; ok {
+			if _, ok := table.Columns[field]; !ok {
+				table.Columns[field] = ix
+			}
+		}
+	}
+	if _, ok := table.Columns[jhuCountryName]; !ok {
+		return nil, &MissingColumnError{Column: jhuCountryName, Header: header}
+	}
+	log.Printf("Read %d rows and %d dates from %s", len(table.Rows), len(table.Dates), file.Name)
+	return
+}
+
+func (table *timeSeriesTable) read(d time.Time, us bool, rows map[string]*timeSeriesRow) {
+	col, ok := table.Dates[reportName(d)]
+	if !ok {
+		return
+	}
+	for _, row := range table.Rows {
+		if col >= len(row) {
+			continue
+		}
+		tsr := timeSeriesRow{
+			FIPS:        normalizeFIPS(table.Columns.get(row, jhuFIPS)),
+			Admin2:      table.Columns.get(row, jhuAdmin2),
+			ProvState:   table.Columns.get(row, jhuProvState),
+			CountryName: table.Columns.get(row, jhuCountryName),
+		}
+		// The US files break the numbers down by county but have no
+		// recovered cases
+		if table.File.Global && us && tsr.CountryName == "US" && table.File.Field != jhuRecovered {
+			continue
+		}
+		key := strings.Join([]string{tsr.FIPS, tsr.Admin2, tsr.ProvState, tsr.CountryName}, "|")
+		dayRow, ok := rows[key]
+		if !ok {
+			dayRow = &timeSeriesRow{}
+			*dayRow = tsr
+			dayRow.Values = make(map[string]string)
+			rows[key] = dayRow
+		}
+		dayRow.Values[table.File.Field] = strings.TrimSpace(row[col])
+	}
+}
+
+func (ts *TimeSeriesSource) Dates(from time.Time, to time.Time) (dates []time.Time, err error) {
+	ts.lock.Lock()
+	err = ts.load(context.Background())
+	ts.lock.Unlock()
+	if err != nil {
+		return
+	}
+	dates = make([]time.Time, 0)
+	for _, d := range ts.dates {
+		if !d.Before(from) && to.After(d) {
+			dates = append(dates, d)
+		}
+	}
+	return
+}
+
+func (ts *TimeSeriesSource) Fetch(ctx context.Context, d time.Time) (data []byte, err error) {
+	// Reports are fetched in parallel
+	ts.lock.Lock()
+	if ts.tables == nil {
+		err = ts.load(ctx)
+	}
+	tables := ts.tables
+	ts.lock.Unlock()
+	if err != nil {
+		return
+	}
+	day := make(map[string]*timeSeriesRow)
+	found := false
+	for _, table := range tables {
+		if _, ok := table.Dates[reportName(d)]; !ok {
+			continue
+		}
+		found = true
+		table.read(d, ts.US, day)
+	}
+	if !found {
+		return nil, fmt.Errorf("time series have no data for %s: %w", d.Format("2006-01-02"), os.ErrNotExist)
+	}
+	keys := make([]string, 0, len(day))
+	for key := range day {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	_ = w.Write([]string{"FIPS", "Admin2", "Province_State", "Country_Region", "Confirmed", "Deaths", "Recovered"})
+	for _, key := range keys {
+		row := day[key]
+		_ = w.Write([]string{
+			row.FIPS,
+			row.Admin2,
+			row.ProvState,
+			row.CountryName,
+			row.Values[jhuConfirmed],
+			row.Values[jhuDeaths],
+			row.Values[jhuRecovered],
+		})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+func (ts *TimeSeriesSource) Parse(d time.Time, data []byte) (records []*SampleRecord, err error) {
+	return parseJHUReport(reportName(d)+".csv", data)
+}
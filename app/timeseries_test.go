@@ -0,0 +1,97 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2020 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testTimeSeries = map[string]string{
+	"time_series_covid19_confirmed_global.csv": "Province/State,Country/Region,Lat,Long,4/1/20,4/2/20\n" +
+		",Netherlands,52,5,10,12\n,US,40,-100,100,120\n",
+	"time_series_covid19_deaths_global.csv": "Province/State,Country/Region,Lat,Long,4/1/20,4/2/20\n" +
+		",Netherlands,52,5,1,2\n,US,40,-100,5,6\n",
+	"time_series_covid19_recovered_global.csv": "Province/State,Country/Region,Lat,Long,4/1/20,4/2/20\n" +
+		",Netherlands,52,5,3,4\n,US,40,-100,7,8\n",
+	"time_series_covid19_confirmed_US.csv": "FIPS,Admin2,Province_State,Country_Region,4/1/20,4/2/20\n" +
+		"36061,New York,New York,US,60,70\n6037,Los Angeles,California,US,40,50\n",
+	"time_series_covid19_deaths_US.csv": "FIPS,Admin2,Province_State,Country_Region,4/1/20,4/2/20\n" +
+		"36061,New York,New York,US,3,4\n6037,Los Angeles,California,US,2,2\n",
+}
+
+func TestTimeSeriesFetch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := testTimeSeries[strings.TrimPrefix(r.URL.Path, "/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(data))
+	}))
+	defer server.Close()
+
+	ts := &TimeSeriesSource{BaseURL: server.URL, US: true, Downloader: testDownloader(0, 0, 5*time.Second)}
+	first := time.Date(2020, 4, 1, 0, 0, 0, 0, time.UTC)
+	dates, err := ts.Dates(first, first.AddDate(0, 0, 7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dates) != 2 || !dates[0].Equal(first) {
+		t.Fatalf("dates %v, expected 04-01 and 04-02", dates)
+	}
+
+	d := first.AddDate(0, 0, 1)
+	data, err := ts.Fetch(context.Background(), d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := ts.Parse(d, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]*SampleRecord)
+	for _, rec := range records {
+		byName[rec.Admin2+"|"+rec.CountryName] = rec
+	}
+	if len(records) != 4 {
+		t.Fatalf("%d records, expected 4: %s", len(records), data)
+	}
+	if nl := byName["|Netherlands"]; nl.Confirmed != 12 || nl.Deceased != 2 || nl.Recovered != 4 {
+		t.Errorf("Netherlands %+v", nl)
+	}
+	if ny := byName["New York|US"]; ny.Confirmed != 70 || ny.Deceased != 4 || ny.FIPS != "36061" {
+		t.Errorf("New York %+v", ny)
+	}
+	// Only the recovered cases are taken from the country level US row
+	if us := byName["|US"]; us.Confirmed != 0 || us.Deceased != 0 || us.Recovered != 8 {
+		t.Errorf("US %+v", us)
+	}
+
+	if _, err = ts.Fetch(context.Background(), first.AddDate(0, 0, 2)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("fetching a date without data: %v", err)
+	}
+}
@@ -0,0 +1,299 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2020 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package app
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/JanDeVisser/grumble"
+	"github.com/JanDeVisser/grumble/handler"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// UnknownRegion is a province or state name which could not be matched to a
+// region of the country it was reported for.
+type UnknownRegion struct {
+	grumble.Key
+	Jurisdiction *Jurisdiction
+	Name         string
+	Source       string
+	Dir          string
+	FirstSeen    time.Time `grumble:"verbose_name=First Seen"`
+	LastSeen     time.Time `grumble:"verbose_name=Last Seen"`
+	Rows         int
+	Resolved     bool
+	Resolution   string
+}
+
+type unknownRegionStats struct {
+	Country   *Jurisdiction
+	Name      string
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Rows      int
+	days      map[time.Time]int
+}
+
+func (stats *unknownRegionStats) seen(d time.Time) {
+	if stats.Rows == 0 || d.Before(stats.FirstSeen) {
+		stats.FirstSeen = d
+	}
+	if stats.Rows == 0 || d.After(stats.LastSeen) {
+		stats.LastSeen = d
+	}
+	stats.Rows++
+	if stats.days == nil {
+		stats.days = make(map[time.Time]int)
+	}
+	stats.days[d]++
+}
+
+// newRows doesn't count the rows of re-imported dates again.
+func (stats *unknownRegionStats) newRows(first time.Time, last time.Time) (rows int) {
+	for d, n := range stats.days {
+		if d.Before(first) || d.After(last) {
+			rows += n
+		}
+	}
+	return
+}
+
+func (stats *unknownRegionStats) persist(mgr *grumble.EntityManager, source SampleSource) (err error) {
+	q := mgr.MakeQuery(UnknownRegion{})
+	q.AddFilter("Name", stats.Name)
+	q.AddCondition(&grumble.References{
+		Column:     "Jurisdiction",
+		References: stats.Country.AsKey(),
+	})
+	e, err := q.ExecuteSingle(nil)
+	if err != nil {
+		return
+	}
+	var ur *UnknownRegion
+	if e == nil {
+		if e, err = mgr.New(UnknownRegion{}, grumble.ZeroKey); err != nil {
+			return
+		}
+		ur = e.(*UnknownRegion)
+		ur.Jurisdiction = stats.Country
+		ur.Name = stats.Name
+		ur.FirstSeen = stats.FirstSeen
+		ur.LastSeen = stats.LastSeen
+		ur.Rows = stats.Rows
+	} else {
+		ur = e.(*UnknownRegion)
+		ur.Rows += stats.newRows(ur.FirstSeen, ur.LastSeen)
+		if stats.FirstSeen.Before(ur.FirstSeen) {
+			ur.FirstSeen = stats.FirstSeen
+		}
+		if stats.LastSeen.After(ur.LastSeen) {
+			ur.LastSeen = stats.LastSeen
+		}
+	}
+	ur.Source = source.Name()
+	ur.Dir = ""
+	if dir, ok := source.(*DirectorySource); ok {
+		ur.Dir = dir.Dir
+	}
+	return mgr.Put(ur)
+}
+
+func persistUnknownRegions(mgr *grumble.EntityManager, source SampleSource, unknown map[string]*unknownRegionStats) (err error) {
+	return mgr.TX(func(db *sql.DB) (err error) {
+		for _, stats := range unknown {
+			log.Printf("Unknown region %q in %s seen %d times%s", stats.Name, stats.Country.Name, stats.Rows,
+				describeSuggestions(Registry.Suggest(stats.Country, stats.Name, 3)))
+			if err = stats.persist(mgr, source); err != nil {
+				return
+			}
+		}
+		return
+	})
+}
+
+// Country returns the cached jurisdiction, which unlike the reference loaded
+// with the UnknownRegion knows its regions.
+func (ur *UnknownRegion) Country() *Jurisdiction {
+	if ur.Jurisdiction == nil {
+		return nil
+	}
+	return Registry.ById(ur.Jurisdiction.Id())
+}
+
+func (ur *UnknownRegion) Candidates() (candidates []*Jurisdiction) {
+	country := ur.Country()
+	if country == nil {
+		return make([]*Jurisdiction, 0)
+	}
+	return country.Regions()
+}
+
+func (ur *UnknownRegion) Suggestions() []*Jurisdiction {
+	country := ur.Country()
+	if country == nil {
+		return make([]*Jurisdiction, 0)
+	}
+	return Registry.Suggest(country, ur.Name, 3)
+}
+
+func (ur *UnknownRegion) Suggested() int {
+	if suggestions := ur.Suggestions(); len(suggestions) > 0 {
+		return suggestions[0].Id()
+	}
+	return 0
+}
+
+func (ur *UnknownRegion) ManyQuery(query *grumble.Query, values url.Values) (ret *grumble.Query) {
+	ret = query
+	if values.Get("all") != "true" {
+		ret.AddFilter("Resolved", false)
+	}
+	ret.AddSort(grumble.Sort{Column: "Rows", Direction: "DESC"})
+	ret.AddReferenceJoins()
+	return
+}
+
+func (ur *UnknownRegion) MakeListContext(req *handler.EntityRequest, data map[string]interface{}) (err error) {
+	data["All"] = req.Values.Get("all")
+	return
+}
+
+func findUnknownRegion(mgr *grumble.EntityManager, id int) (ur *UnknownRegion, err error) {
+	e, err := mgr.Get(UnknownRegion{}, id)
+	if err != nil {
+		return
+	}
+	if e == nil {
+		return nil, fmt.Errorf("unknown region %d not found", id)
+	}
+	return e.(*UnknownRegion), nil
+}
+
+func (ur *UnknownRegion) checkAlias(region *Jurisdiction) error {
+	if ur.Jurisdiction == nil || parentId(region) != ur.Jurisdiction.Id() {
+		return fmt.Errorf("%q is not a region of the country of unknown region %q", region.Name, ur.Name)
+	}
+	return nil
+}
+
+// Resolve creates a new region if region is nil, and otherwise adds the name
+// to its aliases.
+func (ur *UnknownRegion) Resolve(region *Jurisdiction) (err error) {
+	mgr := ur.Manager()
+	country := ur.Country()
+	if country == nil {
+		return fmt.Errorf("country for unknown region %q not found", ur.Name)
+	}
+	return Registry.TX(mgr, func(tx *RegistryTX) (err error) {
+		if region == nil {
+			r := Region{Name: ur.Name}
+			var j *Jurisdiction
+			if j, err = r.Persist(tx, country); err != nil {
+				return
+			}
+			j.Manual = true
+			if err = tx.Put(j); err != nil {
+				return
+			}
+			ur.Resolution = fmt.Sprintf("Created region %q", ur.Name)
+		} else {
+			if err = ur.checkAlias(region); err != nil {
+				return
+			}
+			region = region.Copy()
+			region.Aliases = append(region.Aliases, ur.Name)
+			if err = tx.Put(region); err != nil {
+				return
+			}
+			ur.Resolution = fmt.Sprintf("Alias of %q", region.Name)
+		}
+		ur.Resolved = true
+		return mgr.Put(ur)
+	})
+}
+
+// Reimport re-imports the dates the unknown region was seen from the source it
+// was seen in, whether their reports changed or not.
+func (ur *UnknownRegion) Reimport() (job *ImportJob, err error) {
+	to := ur.LastSeen.AddDate(0, 0, 1)
+	return SubmitImportJob(ur.Manager(), ur.Source, ur.Dir, &ur.FirstSeen, &to, true, true)
+}
+
+func ResolveUnknownRegionRequest(res http.ResponseWriter, req *http.Request) {
+	mgr, err := grumble.MakeEntityManager()
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	id, err := strconv.Atoi(req.FormValue("id"))
+	if err != nil {
+		http.Error(res, fmt.Sprintf("Invalid unknown region id %q", req.FormValue("id")), http.StatusBadRequest)
+		return
+	}
+	ur, err := findUnknownRegion(mgr, id)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusNotFound)
+		return
+	}
+	switch req.FormValue("action") {
+	case "alias":
+		regionId, err := strconv.Atoi(req.FormValue("region"))
+		if err != nil {
+			http.Error(res, fmt.Sprintf("Invalid region id %q", req.FormValue("region")), http.StatusBadRequest)
+			return
+		}
+		region := Registry.ById(regionId)
+		if region == nil {
+			http.Error(res, fmt.Sprintf("Region %d not found", regionId), http.StatusNotFound)
+			return
+		}
+		if err = ur.checkAlias(region); err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = ur.Resolve(region); err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case "create":
+		if err = ur.Resolve(nil); err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case "reimport":
+	default:
+		http.Error(res, fmt.Sprintf("Invalid action %q", req.FormValue("action")), http.StatusBadRequest)
+		return
+	}
+	if req.FormValue("action") == "reimport" || req.FormValue("reimport") == "true" {
+		job, err := ur.Reimport()
+		if err != nil {
+			submitJobError(res, err)
+			return
+		}
+		http.Redirect(res, req, fmt.Sprintf("/import/status?job=%d", job.Id()), http.StatusSeeOther)
+		return
+	}
+	http.Redirect(res, req, "/unknownregion", http.StatusSeeOther)
+}
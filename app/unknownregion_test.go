@@ -0,0 +1,51 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2020 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUnknownRegionNewRows(t *testing.T) {
+	first := time.Date(2020, 4, 1, 0, 0, 0, 0, time.UTC)
+	stats := &unknownRegionStats{}
+	for ix := 0; ix < 4; ix++ {
+		stats.seen(first.AddDate(0, 0, ix))
+		stats.seen(first.AddDate(0, 0, ix))
+	}
+	if stats.Rows != 8 {
+		t.Fatalf("%d rows, expected 8", stats.Rows)
+	}
+	// 04-02 and 04-03 were counted before
+	if rows := stats.newRows(first.AddDate(0, 0, 1), first.AddDate(0, 0, 2)); rows != 4 {
+		t.Errorf("%d new rows, expected 4", rows)
+	}
+	if rows := stats.newRows(first, first.AddDate(0, 0, 3)); rows != 0 {
+		t.Errorf("re-importing all dates counts %d new rows", rows)
+	}
+}
+
+func TestUnknownRegionRejectsAliasOutsideCountry(t *testing.T) {
+	ur := &UnknownRegion{Jurisdiction: testJurisdiction(1, "Netherlands"), Name: "Noord-Holand"}
+	if err := ur.checkAlias(testJurisdiction(2, "Belgium")); err == nil {
+		t.Errorf("unknown region aliased to another country")
+	}
+}
@@ -0,0 +1,399 @@
+/*
+ * This file is part of Covid.
+ *
+ * Copyright (c) 2020 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Covid is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Covid is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Covid.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/JanDeVisser/covid/app"
+	"github.com/JanDeVisser/grumble"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	ExitOK      = 0
+	ExitFailure = 1
+	ExitUsage   = 2
+)
+
+type Command struct {
+	Name  string
+	Usage string
+	Run   func(args []string) error
+}
+
+var errUsage = errors.New("usage")
+
+var commands = []*Command{
+	{Name: "serve", Usage: "Run the web application (default)", Run: serveCommand},
+	{Name: "import", Usage: "Import samples [--from YYYY-MM-DD] [--to YYYY-MM-DD] [--source NAME] [--dir DIR] [--dry-run] [--revise]", Run: importCommand},
+	{Name: "owid", Usage: "Import testing and vaccination metrics from an OWID data file --file FILE [--from YYYY-MM-DD] [--to YYYY-MM-DD]", Run: owidCommand},
+	{Name: "sync", Usage: "Synchronize jurisdictions with the country data", Run: syncCommand},
+	{Name: "rebuild", Usage: "Wipe jurisdictions and samples and re-import everything [--source NAME] [--dir DIR]", Run: rebuildCommand},
+	{Name: "export", Usage: "Export samples as CSV [--from YYYY-MM-DD] [--to YYYY-MM-DD] [--out FILE]", Run: exportCommand},
+	{Name: "deltas", Usage: "Recompute the daily numbers of the samples [--from YYYY-MM-DD] [--to YYYY-MM-DD]", Run: deltasCommand},
+	{Name: "gaps", Usage: "List dates without imported data [--from YYYY-MM-DD] [--to YYYY-MM-DD]", Run: gapsCommand},
+	{Name: "check", Usage: "Reconcile the schema and report on the state of the imports [--samples [--from YYYY-MM-DD] [--to YYYY-MM-DD]]", Run: checkCommand},
+}
+
+func usage(w io.Writer) {
+	_, _ = fmt.Fprintf(w, "Usage: %s <command> [options]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		_, _ = fmt.Fprintf(w, "  %-8s %s\n", cmd.Name, cmd.Usage)
+	}
+}
+
+// RunCommand returns the process exit code. Without arguments the web
+// application is started, which is what App Engine expects.
+func RunCommand(args []string) int {
+	name := "serve"
+	if len(args) > 0 {
+		name = args[0]
+		args = args[1:]
+	}
+	if name == "help" || name == "-h" || name == "--help" {
+		usage(os.Stdout)
+		return ExitOK
+	}
+	for _, cmd := range commands {
+		if cmd.Name == name {
+			if err := cmd.Run(args); err != nil {
+				if err == errUsage || err == flag.ErrHelp {
+					return ExitUsage
+				}
+				log.Printf("%s: %v", name, err)
+				return ExitFailure
+			}
+			return ExitOK
+		}
+	}
+	_, _ = fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+	usage(os.Stderr)
+	return ExitUsage
+}
+
+type dateFlag struct {
+	date *time.Time
+}
+
+func (f *dateFlag) String() string {
+	if f.date == nil {
+		return ""
+	}
+	return f.date.Format("2006-01-02")
+}
+
+func (f *dateFlag) Set(s string) error {
+	d, err := time.ParseInLocation("2006-01-02", s, time.UTC)
+	if err != nil {
+		return err
+	}
+	f.date = &d
+	return nil
+}
+
+func parseFlags(flags *flag.FlagSet, args []string) error {
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		_, _ = fmt.Fprintf(os.Stderr, "Unexpected arguments %q\n", flags.Args())
+		flags.Usage()
+		return errUsage
+	}
+	return nil
+}
+
+func sampleSource(name string, dir string) (app.SampleSource, error) {
+	if dir != "" {
+		return app.MakeDirectorySource(dir), nil
+	}
+	return app.GetSampleSource(name)
+}
+
+func makeEntityManager() (mgr *grumble.EntityManager, err error) {
+	if mgr, err = grumble.MakeEntityManager(); err != nil {
+		return
+	}
+	err = app.CacheJurisdictions(mgr)
+	return
+}
+
+func printProgress(d time.Time, done int, total int, rows int, errors int) {
+	fmt.Printf("[%d/%d] %s: %d rows, %d errors\n", done, total, d.Format("2006-01-02"), rows, errors)
+}
+
+func serveCommand(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	WebApp()
+	return nil
+}
+
+func importCommand(args []string) error {
+	var from, to dateFlag
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	flags.Var(&from, "from", "First date to import (YYYY-MM-DD)")
+	flags.Var(&to, "to", "Import up to but not including this date (YYYY-MM-DD)")
+	sourceName := flags.String("source", "", fmt.Sprintf("Sample source %v", app.SampleSources()))
+	dir := flags.String("dir", "", "Import from this directory of daily report CSV files")
+	dryRun := flags.Bool("dry-run", false, "Parse the reports but don't store any samples")
+	revise := flags.Bool("revise", false, "Fetch all imported reports again, not just the recent ones, and re-import the ones that changed")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	source, err := sampleSource(*sourceName, *dir)
+	if err != nil {
+		return err
+	}
+	mgr, err := makeEntityManager()
+	if err != nil {
+		return err
+	}
+	log.Printf("Importing samples from %s", source.Name())
+	importer := app.MakeImporter(mgr, source)
+	importer.Save = !*dryRun
+	importer.Revise = *revise
+	importer.Progress = printProgress
+	if err = importer.Import(from.date, to.date); err != nil {
+		return err
+	}
+	stats := importer.Stats
+	log.Printf("Imported %d of %d dates: %d rows, %d errors, %d dates locked by another import",
+		stats.Imported, stats.Dates, stats.Rows, stats.Errors, stats.Locked)
+	return nil
+}
+
+func owidCommand(args []string) error {
+	var from, to dateFlag
+	flags := flag.NewFlagSet("owid", flag.ContinueOnError)
+	flags.Var(&from, "from", "First date to import (YYYY-MM-DD)")
+	flags.Var(&to, "to", "Import up to but not including this date (YYYY-MM-DD)")
+	file := flags.String("file", "owid-covid-data.csv", "The OWID data file")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	mgr, err := makeEntityManager()
+	if err != nil {
+		return err
+	}
+	log.Printf("Importing OWID metrics from %s", *file)
+	return app.ImportOWID(mgr, *file, from.date, to.date, printProgress)
+}
+
+func deltasCommand(args []string) error {
+	var from, to dateFlag
+	flags := flag.NewFlagSet("deltas", flag.ContinueOnError)
+	flags.Var(&from, "from", "First date to recompute (YYYY-MM-DD)")
+	flags.Var(&to, "to", "Recompute up to but not including this date (YYYY-MM-DD)")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	mgr, err := makeEntityManager()
+	if err != nil {
+		return err
+	}
+	log.Println("Recomputing daily numbers")
+	return app.RecomputeAllDeltas(mgr, from.date, to.date, printProgress)
+}
+
+func syncCommand(args []string) error {
+	flags := flag.NewFlagSet("sync", flag.ContinueOnError)
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	return app.SyncCountries()
+}
+
+func rebuildCommand(args []string) error {
+	flags := flag.NewFlagSet("rebuild", flag.ContinueOnError)
+	sourceName := flags.String("source", "", fmt.Sprintf("Sample source %v", app.SampleSources()))
+	dir := flags.String("dir", "", "Import from this directory of daily report CSV files")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	source, err := sampleSource(*sourceName, *dir)
+	if err != nil {
+		return err
+	}
+	mgr, err := makeEntityManager()
+	if err != nil {
+		return err
+	}
+	log.Println("Rebuilding jurisdictions")
+	if err = app.Rebuild(mgr); err != nil {
+		return err
+	}
+	log.Printf("Importing samples from %s", source.Name())
+	importer := app.MakeImporter(mgr, source)
+	importer.Progress = printProgress
+	return importer.Import(nil, nil)
+}
+
+func gapsCommand(args []string) (err error) {
+	var from, to dateFlag
+	flags := flag.NewFlagSet("gaps", flag.ContinueOnError)
+	flags.Var(&from, "from", "First date to report on (YYYY-MM-DD)")
+	flags.Var(&to, "to", "Report up to but not including this date (YYYY-MM-DD)")
+	if err = parseFlags(flags, args); err != nil {
+		return
+	}
+	mgr, err := grumble.MakeEntityManager()
+	if err != nil {
+		return
+	}
+	start := app.JHUFirstReport
+	if from.date != nil {
+		start = *from.date
+	}
+	end := time.Now().UTC().AddDate(0, 0, 1)
+	if to.date != nil {
+		end = *to.date
+	}
+	gaps, err := app.ImportGaps(mgr, start, end)
+	if err != nil {
+		return
+	}
+	for _, gap := range gaps {
+		fmt.Printf("%s: %s", gap.Date.Format("2006-01-02"), gap.Status)
+		if gap.Attempts > 0 {
+			fmt.Printf(", %d attempts", gap.Attempts)
+		}
+		if gap.NextAttempt != nil {
+			fmt.Printf(", next attempt %s", gap.NextAttempt.Format(time.RFC3339))
+		}
+		if gap.Message != "" {
+			fmt.Printf(": %s", gap.Message)
+		}
+		fmt.Println()
+	}
+	fmt.Printf("%d dates without data\n", len(gaps))
+	return
+}
+
+func exportCommand(args []string) (err error) {
+	var from, to dateFlag
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.Var(&from, "from", "First date to export (YYYY-MM-DD)")
+	flags.Var(&to, "to", "Export up to but not including this date (YYYY-MM-DD)")
+	outFile := flags.String("out", "", "Write to this file instead of standard output")
+	if err = parseFlags(flags, args); err != nil {
+		return
+	}
+	mgr, err := makeEntityManager()
+	if err != nil {
+		return
+	}
+	var w io.Writer = os.Stdout
+	if *outFile != "" {
+		var f *os.File
+		if f, err = os.Create(*outFile); err != nil {
+			return
+		}
+		defer func() {
+			e := f.Close()
+			if err == nil {
+				err = e
+			}
+		}()
+		w = f
+	}
+	return app.ExportSamples(mgr, w, from.date, to.date)
+}
+
+func checkCommand(args []string) (err error) {
+	var from, to dateFlag
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	samples := flags.Bool("samples", false, "Check the imported samples against the data quality rules")
+	flags.Var(&from, "from", "First date to check the samples of (YYYY-MM-DD)")
+	flags.Var(&to, "to", "Check samples up to but not including this date (YYYY-MM-DD)")
+	if err = parseFlags(flags, args); err != nil {
+		return
+	}
+	mgr, err := grumble.MakeEntityManager()
+	if err != nil {
+		return
+	}
+	log.Println("Reconciling schema")
+	if err = ReconcileSchema(mgr); err != nil {
+		return
+	}
+	if err = app.CacheJurisdictions(mgr); err != nil {
+		return
+	}
+	q := mgr.MakeQuery(app.ImportRecord{})
+	q.AddSort(grumble.Sort{Column: "JHUFile", Direction: "ASC"})
+	results, err := q.Execute()
+	if err != nil {
+		return
+	}
+	failed := 0
+	for _, row := range results {
+		imp := row[0].(*app.ImportRecord)
+		if imp.ErrorCount > 0 || imp.State() == app.ImportFailed {
+			failed++
+			fmt.Printf("%s: %s, %d rows imported, %d errors\n", imp.JHUFile, imp.State(), imp.Count, imp.ErrorCount)
+		}
+	}
+	fmt.Printf("%d import records, %d with errors\n", len(results), failed)
+	if *samples {
+		if err = checkSamples(mgr, from.date, to.date); err != nil {
+			return
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d import records with errors", failed)
+	}
+	return
+}
+
+func checkSamples(mgr *grumble.EntityManager, from *time.Time, to *time.Time) (err error) {
+	oldest, newest, err := app.OldestAndNewestSample(mgr)
+	if err != nil {
+		return
+	}
+	start, end := oldest, newest.AddDate(0, 0, 1)
+	if from != nil {
+		start = *from
+	}
+	if to != nil {
+		end = *to
+	}
+	log.Printf("Checking samples from %s up to %s", start.Format("2006-01-02"), end.Format("2006-01-02"))
+	findings, err := app.CheckSamples(mgr, start, end, nil)
+	if err != nil {
+		return
+	}
+	counts := make(map[string]int)
+	for _, f := range findings {
+		counts[f.Rule]++
+		fmt.Printf("%s: %s: %s\n", f.Date.Format("2006-01-02"), f.Rule, f.Message)
+	}
+	for _, rule := range app.FindingRules {
+		fmt.Printf("%s: %d findings\n", rule, counts[rule])
+	}
+	return
+}
@@ -37,8 +37,14 @@ func WebApp() {
 	handler.RegisterHandlerFnc("ChartDeathsByGDP", app.DeathsByGDP)
 	handler.RegisterHandlerFnc("ChartDeathsByMedianAge", app.DeathsByMedianAge)
 	handler.RegisterHandlerFnc("ImportSamples", app.ImportRequest)
+	handler.RegisterHandlerFnc("ImportStatus", app.ImportStatusRequest)
+	handler.RegisterHandlerFnc("ImportGaps", app.ImportGapsRequest)
+	handler.RegisterHandlerFnc("CheckSamples", app.CheckRequest)
 	handler.RegisterHandlerFnc("Rebuild", app.RebuildRequest)
 	handler.RegisterHandlerFnc("SyncCountries", app.SyncCountriesRequest)
+	handler.RegisterHandlerFnc("ResolveUnknownRegion", app.ResolveUnknownRegionRequest)
+	handler.RegisterHandlerFnc("ReloadNormalization", app.ReloadNormalizationRequest)
+	handler.RegisterHandlerFnc("FetchCache", app.FetchCacheRequest)
 	handler.RegisterHandlerFnc("ClearCache", ClearCacheRequest)
 	handler.RegisterHandlerFnc("Wipe", WipeRequest)
 	mgr, err := grumble.MakeEntityManager()
@@ -48,42 +54,59 @@ func WebApp() {
 	if err := app.CacheJurisdictions(mgr); err != nil {
 		log.Fatal(err)
 	}
+	if err := app.LoadNormalizationRules(); err != nil {
+		log.Fatal(err)
+	}
+	if err := app.StartImportWorker(mgr); err != nil {
+		log.Fatal(err)
+	}
 	handler.StartApp(true)
 }
 
 func ClearCacheRequest(res http.ResponseWriter, req *http.Request) {
-	if err := os.RemoveAll("cache/"); err != nil {
+	if err := app.MakeFetchCache().Clear(); err != nil {
 		http.Error(res, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	http.Redirect(res, req, "/index.html", http.StatusTemporaryRedirect)
 }
 
+func ReconcileSchema(mgr *grumble.EntityManager) error {
+	err := mgr.TX(func(db *sql.DB) error {
+		for _, k := range grumble.Kinds() {
+			if e := k.Reconcile(mgr.PostgreSQLAdapter); e != nil {
+				return e
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return app.Migrate(mgr)
+}
+
+func Wipe(mgr *grumble.EntityManager) (err error) {
+	if err = mgr.ResetSchema(); err != nil {
+		return
+	}
+	if err = ReconcileSchema(mgr); err != nil {
+		return
+	}
+	return app.SyncCountries()
+}
+
 func WipeRequest(res http.ResponseWriter, req *http.Request) {
 	if req.FormValue("magic") != "DEADBEEF" {
 		http.Error(res, "Missing magic value", http.StatusInternalServerError)
 	}
-	if mgr, err := grumble.MakeEntityManager(); err == nil {
-		if err = mgr.ResetSchema(); err == nil {
-			if err = mgr.TX(func(db *sql.DB) error {
-				for _, k := range grumble.Kinds() {
-					if e := k.Reconcile(mgr.PostgreSQLAdapter); e != nil {
-						return e
-					}
-				}
-				return nil
-			}); err != nil {
-				http.Error(res, err.Error(), http.StatusInternalServerError)
-			}
-		} else {
-			http.Error(res, err.Error(), http.StatusInternalServerError)
-			return
-		}
-	} else {
+	mgr, err := grumble.MakeEntityManager()
+	if err != nil {
 		http.Error(res, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if err := app.SyncCountries(); err != nil {
+	if err = Wipe(mgr); err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	http.Redirect(res, req, "/import", http.StatusTemporaryRedirect)
@@ -93,5 +116,12 @@ func main() {
 	grumble.GetKind(&app.Jurisdiction{})
 	grumble.GetKind(&app.Sample{})
 	grumble.GetKind(&app.ImportRecord{})
-	WebApp()
+	grumble.GetKind(&app.ImportLock{})
+	grumble.GetKind(&app.ImportError{})
+	grumble.GetKind(&app.UnknownRegion{})
+	grumble.GetKind(&app.ImportJob{})
+	grumble.GetKind(&app.SampleRevision{})
+	grumble.GetKind(&app.Finding{})
+	grumble.GetKind(&app.Migration{})
+	os.Exit(RunCommand(os.Args[1:]))
 }
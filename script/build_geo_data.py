@@ -13,6 +13,7 @@ class Jurisdiction:
         self.name = m["name"]
         self.alpha2 = m.get("alpha-2", "")
         self.alpha3 = m.get("alpha-3", "")
+        self.fips = m.get("fips", "")
         self.population = 0
         self.medianage = 0.0
         self.GDPperCapPPP = 0.0
@@ -43,6 +44,7 @@ class JurisdictionEncoder(json.JSONEncoder):
                 "name": obj.name,
                 "alpha-2": obj.alpha2,
                 "alpha-3": obj.alpha3,
+                "fips": obj.fips,
                 "population": obj.population,
                 "medianage": obj.medianage,
                 "gdppercapppp": obj.GDPperCapPPP,